@@ -1,38 +1,57 @@
 package fileutils
 
 import (
+	"bytes"
 	"encoding/binary"
 	"io"
-	"os"
+	"io/fs"
+	"io/ioutil"
 	"reflect"
 
 	"github.com/infobaleen/errors"
 )
 
-func ReadBinaryFile(filename string, p interface{}) error {
+func ReadBinaryFile(filename string, p interface{}, opts ...Option) error {
+	return ReadBinaryFileFS(toIOFS(opts), filename, p, opts...)
+}
+
+// ReadBinaryFileFS is like ReadBinaryFile, but reads from fsys.
+func ReadBinaryFileFS(fsys fs.FS, name string, p interface{}, opts ...Option) error {
 	var val = toValue(p)
 	if val.Kind() != reflect.Ptr {
 		return errors.Fmt("expected pointer")
 	}
 	val = recursiveIndirect(val)
-	var file, err = os.Open(filename)
+	var file, r, encoded, err = openDecoded(fsys, name, opts)
 	if err != nil {
 		return errors.WithTrace(err)
 	}
 	defer file.Close()
 	if val.Kind() == reflect.Slice {
 		var elemSize = sizeBinary(reflect.New(val.Type().Elem()))
-		var fileInfo, err = file.Stat()
-		if err != nil {
-			return errors.WithTrace(err)
+		var size int64
+		if !encoded {
+			var fileInfo, err = file.Stat()
+			if err != nil {
+				return errors.WithTrace(err)
+			}
+			size = fileInfo.Size()
+		} else {
+			// the size is only known after decoding
+			var content, err = ioutil.ReadAll(r)
+			if err != nil {
+				return errors.WithTrace(err)
+			}
+			size = int64(len(content))
+			r = bytes.NewReader(content)
 		}
-		var len = int(fileInfo.Size() / int64(elemSize))
+		var len = int(size / int64(elemSize))
 		if val.Cap() < len {
 			val.Set(reflect.MakeSlice(val.Type(), 0, len))
 		}
 		val.SetLen(len)
 	}
-	return binary.Read(file, binary.LittleEndian, p)
+	return binary.Read(r, binary.LittleEndian, p)
 }
 
 func sizeBinary(v reflect.Value) int {
@@ -71,15 +90,27 @@ func SizeBinary(v interface{}) int {
 	return sizeBinary(toValue(v))
 }
 
-func WriteBinaryFile(filename string, v interface{}) error {
-	var file, err = CreateFileTmp(filename)
+func WriteBinaryFile(filename string, v interface{}, opts ...Option) error {
+	var o = newOptions(opts)
+	var size int64 = -1
+	if o.checkSpace || o.progress != nil {
+		size = int64(SizeBinary(v))
+	}
+	if o.checkSpace {
+		opts = append([]Option{ExpectedSize(size)}, opts...)
+	}
+	var file, err = CreateFileTmp(filename, opts...)
 	if err != nil {
 		return err
 	}
 	defer file.RemoveIfTmp()
-	err = writeBinary(file, toValue(v))
-	if err != nil {
-		return err
+	var m = newMonitor(o, filename, size)
+	err = writeBinary(monitoredWriter{file, m}, toValue(v))
+	if err == nil {
+		err = file.Close()
+	}
+	if err == nil {
+		m.finish()
 	}
-	return file.Close()
+	return err
 }
@@ -0,0 +1,249 @@
+package fileutils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/infobaleen/errors"
+)
+
+// ChecksumAlgorithm is an algorithm used to detect corrupted files.
+type ChecksumAlgorithm int
+
+const (
+	// ChecksumNone disables checksums.
+	ChecksumNone ChecksumAlgorithm = iota
+	// ChecksumCRC32C is CRC-32 with the Castagnoli polynomial, which is fast but only detects accidental corruption.
+	ChecksumCRC32C
+	// ChecksumSHA256 is SHA-256.
+	ChecksumSHA256
+)
+
+func (a ChecksumAlgorithm) String() string {
+	switch a {
+	case ChecksumNone:
+		return "none"
+	case ChecksumCRC32C:
+		return "crc32c"
+	case ChecksumSHA256:
+		return "sha256"
+	}
+	return "unknown"
+}
+
+func (a ChecksumAlgorithm) newHash() hash.Hash {
+	switch a {
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case ChecksumSHA256:
+		return sha256.New()
+	}
+	return nil
+}
+
+// ChecksumPlacement is where the checksum of a file is stored.
+type ChecksumPlacement int
+
+const (
+	// ChecksumTrailer appends the checksum to the file, so it is replaced atomically together with the contents.
+	// Files with trailers must be read with the WithChecksum option.
+	ChecksumTrailer ChecksumPlacement = iota
+	// ChecksumSidecar writes the checksum to a file named like the file with the name of the algorithm as additional
+	// extension, e.g. "data.bin.sha256", in the format of sha256sum. The sidecar is written after the file is finalized,
+	// so it is stale if the process dies in between.
+	ChecksumSidecar
+)
+
+// The trailer consists of the digest followed by a footer of the magic, the algorithm and the length of the digest.
+const checksumMagic = "FUSUM\x01"
+const checksumFooterSize = len(checksumMagic) + 2
+
+// CorruptionError is returned when the checksum of a file doesn't match its contents or is missing.
+type CorruptionError struct {
+	Path      string
+	Algorithm ChecksumAlgorithm
+	// Expected is the stored checksum. It is nil if the checksum is missing.
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *CorruptionError) Error() string {
+	if e.Expected == nil {
+		return fmt.Sprintf("%s checksum of %q is missing", e.Algorithm, e.Path)
+	}
+	return fmt.Sprintf("%s checksum of %q is %x instead of %x", e.Algorithm, e.Path, e.Actual, e.Expected)
+}
+
+// WithChecksum makes created files (see CreateFileTmp) and the writing functions compute the checksum of the written
+// bytes and store it when the file is finalized, and makes the reading functions and MmapSlices verify it before using
+// the contents. The checksum covers the bytes on disk, i.e. after compression and encryption.
+// It is computed while writing and recomputed if the file is changed by other means than Write.
+// Once the file is finalized, later changes are not covered. MmapCreateSlices rejects checksums,
+// because the contents are written after the file is finalized.
+func WithChecksum(algorithm ChecksumAlgorithm, placement ChecksumPlacement) Option {
+	return func(o *options) {
+		o.checksum = algorithm
+		o.checksumPlacement = placement
+	}
+}
+
+// Verify checks the checksum of the file, which is stored as configured by the WithChecksum option.
+func Verify(path string, opts ...Option) error {
+	var o = newOptions(opts)
+	if o.checksum == ChecksumNone {
+		return errors.Fmt("no checksum algorithm")
+	}
+	var fsys = toIOFS(opts)
+	var file, err = fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	_, err = verifyChecksum(fsys, path, file, o)
+	return errors.WithAftermath(err, file.Close())
+}
+
+// checksummer computes the checksum of a created file.
+type checksummer struct {
+	algorithm ChecksumAlgorithm
+	placement ChecksumPlacement
+	hash      hash.Hash
+	// valid is true while the hash covers the file, i.e. it was only written by Write
+	valid bool
+}
+
+// invalidateChecksum makes the checksum be recomputed, because the file was changed by other means than Write.
+func (f *File) invalidateChecksum() {
+	if f.checksum != nil {
+		f.checksum.valid = false
+	}
+}
+
+// finishChecksum computes the checksum and writes the trailer. Nothing can be written afterwards.
+// The buffers must be empty.
+func (f *File) finishChecksum() ([]byte, error) {
+	var err = f.closeEncoders()
+	if err != nil {
+		return nil, err
+	}
+	var c = f.checksum
+	var info os.FileInfo
+	info, err = f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !c.valid {
+		c.hash.Reset()
+		_, err = io.Copy(c.hash, io.NewSectionReader(f.file, 0, info.Size()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	var sum = c.hash.Sum(nil)
+	if c.placement == ChecksumTrailer {
+		var trailer = append(append(sum[:len(sum):len(sum)], checksumMagic...), byte(c.algorithm), byte(len(sum)))
+		var start = time.Now()
+		var n int
+		n, err = f.file.WriteAt(trailer, info.Size())
+		observe(f.observer, Event{Kind: EventWrite, Path: f.filepath, Bytes: int64(n), Err: err}, start)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sum, nil
+}
+
+// writeSidecar writes the sidecar of a finalized file.
+func (f *File) writeSidecar(sum []byte) error {
+	var line = fmt.Sprintf("%x  %s\n", sum, filepath.Base(f.target))
+	return WriteFile(sidecarPath(f.target, f.checksum.algorithm), []byte(line), WithFS(f.fs),
+		WithDurability(f.durability), WithObserver(f.observer))
+}
+
+func sidecarPath(name string, algorithm ChecksumAlgorithm) string {
+	return name + "." + algorithm.String()
+}
+
+// verifyChecksum checks the checksum of file, which was opened at name, and returns a reader for the contents
+// without trailer.
+func verifyChecksum(fsys fs.FS, name string, file fs.File, o options) (*io.SectionReader, error) {
+	var ra, ok = file.(io.ReaderAt)
+	var size int64
+	if ok {
+		var info, err = file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		size = info.Size()
+	} else {
+		var content, err = ioutil.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		ra, size = bytes.NewReader(content), int64(len(content))
+	}
+
+	var expected []byte
+	var corruption = &CorruptionError{Path: name, Algorithm: o.checksum}
+	if o.checksumPlacement == ChecksumTrailer {
+		var footer = make([]byte, checksumFooterSize)
+		if size < int64(len(footer)) {
+			return nil, corruption
+		}
+		var _, err = ra.ReadAt(footer, size-int64(len(footer)))
+		if err != nil {
+			return nil, err
+		}
+		var trailerSize = int64(len(footer)) + int64(footer[len(footer)-1])
+		if string(footer[:len(checksumMagic)]) != checksumMagic || size < trailerSize {
+			return nil, corruption
+		}
+		if algorithm := ChecksumAlgorithm(footer[len(checksumMagic)]); algorithm != o.checksum {
+			return nil, errors.Fmt("checksum of %q uses %s instead of %s", name, algorithm, o.checksum)
+		}
+		size -= trailerSize
+		expected = make([]byte, footer[len(footer)-1])
+		_, err = ra.ReadAt(expected, size)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var line, err = fs.ReadFile(fsys, sidecarPath(name, o.checksum))
+		if os.IsNotExist(err) {
+			return nil, corruption
+		} else if err != nil {
+			return nil, err
+		}
+		var fields = strings.Fields(string(line))
+		if len(fields) > 0 {
+			expected, err = hex.DecodeString(fields[0])
+		}
+		if len(fields) == 0 || err != nil {
+			return nil, errors.Fmt("invalid checksum file for %q", name)
+		}
+	}
+
+	var h = o.checksum.newHash()
+	var r = io.NewSectionReader(ra, 0, size)
+	var _, err = io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	var actual = h.Sum(nil)
+	if !bytes.Equal(actual, expected) {
+		corruption.Expected, corruption.Actual = expected, actual
+		return nil, corruption
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	return r, err
+}
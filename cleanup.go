@@ -0,0 +1,83 @@
+package fileutils
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/infobaleen/errors"
+)
+
+// IsTmpName reports whether name is the name of a temporary file created by CreateFileTmp with the default pattern
+// or with HiddenTmp.
+func IsTmpName(name string) bool {
+	var idx = strings.LastIndex(name, ".tmp")
+	if idx <= 0 || (name[0] == '.' && idx == 1) {
+		return false
+	}
+	var number, ok = IsNumberedName(name, name[:idx+len(".tmp")], "")
+	return ok && number <= math.MaxUint16
+}
+
+// CleanupTmpFiles removes temporary files that were left behind in dir by CreateFileTmp, e.g. because the process died
+// before finalizing them. Only files named by the default pattern or HiddenTmp, that were last modified more than
+// olderThan ago and that are not in use by an open File are removed. On platforms without flock, such as Windows, where
+// it can't be detected whether temporary files are in use, nothing is removed.
+// The paths of all removed files are returned, even if an error occurred for some other file.
+func CleanupTmpFiles(dir string, olderThan time.Duration) ([]string, error) {
+	var infos, err = ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	var errs error
+	var deadline = time.Now().Add(-olderThan)
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || !IsTmpName(info.Name()) || info.ModTime().After(deadline) {
+			continue
+		}
+		var path = filepath.Join(dir, info.Name())
+		var ok, err = removeUnusedTmp(path)
+		if ok {
+			removed = append(removed, path)
+		} else if err != nil && !os.IsNotExist(errors.Cause(err)) {
+			errs = appendError(errs, errors.Wrap(err, "removing %q failed", path))
+		}
+	}
+	return removed, errs
+}
+
+// CleanupTmpFilesRecursive is like CleanupTmpFiles, but also cleans up all subdirectories.
+func CleanupTmpFilesRecursive(dir string, olderThan time.Duration) ([]string, error) {
+	var removed, errs = CleanupTmpFiles(dir, olderThan)
+	var infos, err = ioutil.ReadDir(dir)
+	if err != nil {
+		return removed, appendError(errs, err)
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			var subRemoved, err = CleanupTmpFilesRecursive(filepath.Join(dir, info.Name()), olderThan)
+			removed = append(removed, subRemoved...)
+			errs = appendError(errs, err)
+		}
+	}
+	return removed, errs
+}
+
+func removeUnusedTmp(path string) (bool, error) {
+	var file, err = os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	var unused bool
+	unused, err = lockTmpUnused(file)
+	if err != nil || !unused {
+		return false, err
+	}
+	err = os.Remove(path)
+	return err == nil, err
+}
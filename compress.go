@@ -0,0 +1,210 @@
+package fileutils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/infobaleen/errors"
+)
+
+// Compression is a format used to compress files transparently.
+type Compression int
+
+const (
+	// CompressionNone disables compression. Unlike the default, it also disables the detection of compressed files when
+	// reading.
+	CompressionNone Compression = iota
+	// CompressionGzip is the gzip format, which CompressionAuto selects for names ending with ".gz".
+	CompressionGzip
+	// CompressionZlib is the zlib format (deflate with a small header), which CompressionAuto selects for names ending
+	// with ".zz" or ".zlib".
+	CompressionZlib
+
+	// CompressionAuto selects the compression by the extension of the name. When reading files without such an
+	// extension, gzip and zlib are detected by their magic bytes.
+	CompressionAuto Compression = -1
+
+	// compressionDetect is the default, which doesn't compress written files, but detects gzip and zlib by their magic
+	// bytes when reading.
+	compressionDetect Compression = -2
+)
+
+// ErrCompressed is the cause of errors returned by operations that are not supported for compressed files, like
+// Seek, ReadAt and WriteAt.
+const ErrCompressed = constError("operation is not supported for compressed files")
+
+var gzipMagic = []byte{0x1f, 0x8b, 0x08}
+
+const (
+	zlibMagic = 0x78 // deflate with a 32 KiB window
+	zlibDict  = 0x20 // flag of headers that are followed by a preset dictionary
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZlib:
+		return "zlib"
+	case CompressionAuto:
+		return "auto"
+	}
+	return "unknown"
+}
+
+// Compress sets the compression of files. By default, written files are not compressed, while the reading functions
+// like ReadFile detect gzip and zlib by their magic bytes, so that compressed and uncompressed files are read alike.
+// CompressionNone disables the detection, e.g. to read the raw bytes of compressed files. With CompressionAuto, files
+// are compressed according to the extension of their name and detected by their magic bytes otherwise. Created files (see CreateFileTmp) are write-only while compressed and the compressed stream is
+// completed when they are finalized. Files opened with OpenFile are never decompressed. Copy compresses the copy, but
+// doesn't decompress the original.
+func Compress(c Compression) Option {
+	return func(o *options) {
+		o.compression = c
+	}
+}
+
+// compressionFor returns the compression of a file that is written to name.
+func compressionFor(name string, c Compression) Compression {
+	if c == compressionDetect {
+		return CompressionNone
+	} else if c != CompressionAuto {
+		return c
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gz":
+		return CompressionGzip
+	case ".zz", ".zlib":
+		return CompressionZlib
+	}
+	return CompressionNone
+}
+
+// compressor is implemented by the writers of the compress packages.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newCompressor(c Compression, w io.Writer) compressor {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewWriter(w)
+	case CompressionZlib:
+		return zlib.NewWriter(w)
+	}
+	return nil
+}
+
+// decompressReader returns a reader for the decompressed contents read from r, which was opened at name, and the
+// compression that was used.
+func decompressReader(r io.Reader, name string, c Compression) (io.Reader, Compression, error) {
+	if c == CompressionAuto {
+		c = compressionFor(name, c)
+		if c == CompressionNone {
+			c = compressionDetect
+		}
+	}
+	if c == compressionDetect {
+		var br = bufio.NewReader(r)
+		r = br
+		c = detectCompression(br)
+	}
+	var dr io.Reader
+	var err error
+	switch c {
+	case CompressionGzip:
+		dr, err = gzip.NewReader(r)
+	case CompressionZlib:
+		dr, err = zlib.NewReader(r)
+	default:
+		return r, c, nil
+	}
+	if err != nil {
+		return nil, c, errors.Wrap(err, "decompressing %q failed", name)
+	}
+	return dr, c, nil
+}
+
+// detectCompression returns the compression of the contents of r by their magic bytes, without consuming them.
+// The zlib header is only recognized with the default window size, which all common encoders use, to keep the chance
+// of misdetecting uncompressed contents low.
+func detectCompression(r *bufio.Reader) Compression {
+	var magic, _ = r.Peek(len(gzipMagic))
+	if bytes.Equal(magic, gzipMagic) {
+		return CompressionGzip
+	}
+	if len(magic) >= 2 && magic[0] == zlibMagic && magic[1]&zlibDict == 0 && (uint(magic[0])<<8|uint(magic[1]))%31 == 0 {
+		return CompressionZlib
+	}
+	return CompressionNone
+}
+
+// openDecoded opens a file of fsys, verifies its checksum and returns a reader for its decrypted and decompressed
+// contents and whether the contents differ from the file. The file must be closed by the caller.
+func openDecoded(fsys fs.FS, name string, opts []Option) (fs.File, io.Reader, bool, error) {
+	var file, err = fsys.Open(name)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	var o = newOptions(opts)
+	var r io.Reader = file
+	var trailer bool
+	if o.checksum != ChecksumNone {
+		r, err = verifyChecksum(fsys, name, file, o)
+		if err != nil {
+			return nil, nil, false, errors.WithAftermath(err, file.Close())
+		}
+		trailer = o.checksumPlacement == ChecksumTrailer
+	}
+	var encrypted bool
+	var c Compression
+	r, encrypted, err = decryptingReader(r, name, o.keys)
+	if err == nil {
+		r, c, err = decompressReader(r, name, o.compression)
+	}
+	if err != nil {
+		return nil, nil, false, errors.WithAftermath(err, file.Close())
+	}
+	return file, r, trailer || encrypted || c != CompressionNone, nil
+}
+
+// encoded returns whether writes are compressed or encrypted.
+func (f *File) encoded() bool {
+	return f.compressor != nil || f.encryptor != nil
+}
+
+// closeEncoders completes the compressed and encrypted streams, after which nothing can be written.
+func (f *File) closeEncoders() error {
+	if !f.encoded() {
+		return nil
+	}
+	var err = f.writeBuffer.Flush()
+	if err == nil && f.compressor != nil {
+		err = f.compressor.Close()
+	}
+	if err == nil && f.encryptor != nil {
+		err = f.encryptor.Close()
+	}
+	f.compressor = nil
+	f.encryptor = nil
+	return err
+}
+
+// ifEncodedError returns an error caused by ErrCompressed or ErrEncrypted if the file is compressed or encrypted.
+func (f *File) ifEncodedError() error {
+	if f.compressor != nil {
+		return errors.Wrap(ErrCompressed, "file %q is compressed", f.filepath)
+	} else if f.encryptor != nil {
+		return errors.Wrap(ErrEncrypted, "file %q is encrypted", f.filepath)
+	}
+	return nil
+}
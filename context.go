@@ -0,0 +1,147 @@
+package fileutils
+
+import (
+	"context"
+	"io"
+
+	"github.com/infobaleen/errors"
+)
+
+// contextChunkSize is the maximum number of bytes that are written or copied between checks of the context and
+// progress reports.
+const contextChunkSize = 1 << 20
+
+// withContext makes functions check ctx for cancellation. It is set by the *Context variants of functions.
+func withContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+// monitor checks for cancellation and reports the progress of a long operation. Its methods do nothing for nil.
+type monitor struct {
+	ctx      context.Context
+	path     string
+	progress *progressReporter
+}
+
+// newMonitor returns a monitor for an operation of total bytes (-1 if unknown), or nil if it isn't needed.
+func newMonitor(o options, path string, total int64) *monitor {
+	if o.ctx == nil && o.progress == nil {
+		return nil
+	}
+	var m = &monitor{ctx: o.ctx, path: path}
+	if o.progress != nil {
+		m.progress = &progressReporter{fn: o.progress, interval: o.progressInterval,
+			current: Progress{Total: total, Path: path}}
+	}
+	return m
+}
+
+// setPath sets the path that is processed.
+func (m *monitor) setPath(path string) {
+	if m != nil {
+		m.path = path
+		if m.progress != nil {
+			m.progress.current.Path = path
+		}
+	}
+}
+
+// check returns the error of the context, wrapped with the path that is processed, once the context is done.
+func (m *monitor) check() error {
+	if m == nil || m.ctx == nil {
+		return nil
+	}
+	if err := m.ctx.Err(); err != nil {
+		return errors.Wrap(err, "processing %q was canceled", m.path)
+	}
+	return nil
+}
+
+// advance adds n processed bytes.
+func (m *monitor) advance(n int64) {
+	if m != nil && m.progress != nil {
+		m.progress.add(n)
+	}
+}
+
+// finish reports the completed operation.
+func (m *monitor) finish() {
+	if m != nil && m.progress != nil {
+		m.progress.finish()
+	}
+}
+
+// monitoredReader checks for cancellation before every read and reports the bytes that were read.
+type monitoredReader struct {
+	r io.Reader
+	m *monitor
+}
+
+func (r monitoredReader) Read(b []byte) (int, error) {
+	if err := r.m.check(); err != nil {
+		return 0, err
+	}
+	var n, err = r.r.Read(b)
+	r.m.advance(int64(n))
+	return n, err
+}
+
+// monitoredWriter splits writes into chunks, checks for cancellation before every chunk and reports the bytes that
+// were written.
+type monitoredWriter struct {
+	w io.Writer
+	m *monitor
+}
+
+func (w monitoredWriter) Write(b []byte) (int, error) {
+	var n int
+	for len(b) > 0 {
+		if err := w.m.check(); err != nil {
+			return n, err
+		}
+		var chunk = b
+		if len(chunk) > contextChunkSize {
+			chunk = chunk[:contextChunkSize]
+		}
+		var written, err = w.w.Write(chunk)
+		w.m.advance(int64(written))
+		n += written
+		if err != nil {
+			return n, err
+		}
+		b = b[written:]
+	}
+	return n, nil
+}
+
+// CopyContext is like Copy, but stops with an error caused by ctx.Err() if ctx is done before the copy is complete.
+// The temporary file is removed in that case.
+func CopyContext(ctx context.Context, oldPath, newPath string, opts ...Option) error {
+	return Copy(oldPath, newPath, append(opts[:len(opts):len(opts)], withContext(ctx))...)
+}
+
+// WriteBinaryFileContext is like WriteBinaryFile, but stops with an error caused by ctx.Err() if ctx is done before
+// all values are written. The temporary file is removed in that case.
+func WriteBinaryFileContext(ctx context.Context, filename string, v interface{}, opts ...Option) error {
+	return WriteBinaryFile(filename, v, append(opts[:len(opts):len(opts)], withContext(ctx))...)
+}
+
+// ReadJsonFileAppendContext is like ReadJsonFileAppend, but stops with an error caused by ctx.Err() if ctx is done
+// before all values are read. The values that were read before are kept.
+func ReadJsonFileAppendContext(ctx context.Context, filename string, p interface{}, opts ...Option) error {
+	return ReadJsonFileAppend(filename, p, append(opts[:len(opts):len(opts)], withContext(ctx))...)
+}
+
+// UntarContext is like Untar, but stops with an error caused by ctx.Err() if ctx is done before all entries are
+// extracted. The entries that were extracted before are kept, the partially extracted file is removed.
+func UntarContext(ctx context.Context, dir string, r io.Reader, opts ...Option) error {
+	return Untar(dir, r, append(opts[:len(opts):len(opts)], withContext(ctx))...)
+}
+
+// AddPathContext is like AddPath, but stops with an error caused by ctx.Err() if ctx is done before all files are
+// added. As with other errors of AddPath, the archive is incomplete afterwards.
+func (tw *TarWriter) AddPathContext(ctx context.Context, archivePrefix, diskPath string, opts ...Option) error {
+	return tw.AddPath(archivePrefix, diskPath, append(opts[:len(opts):len(opts)], withContext(ctx))...)
+}
@@ -5,23 +5,221 @@ import (
 	"os"
 )
 
-func Copy(oldPath, newPath string) error {
-	var src, err = os.Open(oldPath)
+// CopyStrategy is the way Copy transferred the data of a file.
+type CopyStrategy int
+
+const (
+	// CopyReflink means that the new file shares the data with the old file until either is modified.
+	CopyReflink CopyStrategy = iota
+	// CopyFileRange means that the data was copied inside the kernel, possibly by the filesystem itself.
+	CopyFileRange
+	// CopySendfile means that the data was copied inside the kernel using sendfile.
+	CopySendfile
+	// CopyBuffered means that the data was read into a buffer and written to the new file.
+	CopyBuffered
+)
+
+func (s CopyStrategy) String() string {
+	switch s {
+	case CopyReflink:
+		return "reflink"
+	case CopyFileRange:
+		return "copy_file_range"
+	case CopySendfile:
+		return "sendfile"
+	case CopyBuffered:
+		return "buffered"
+	}
+	return "unknown"
+}
+
+// Copy copies a file using a temporary file that is finalized at newPath.
+// The fastest strategy supported by the platform and filesystems is used: reflink, copy_file_range, sendfile or
+// a buffered copy. Options can be used to preserve metadata and holes and to learn which strategy was used.
+func Copy(oldPath, newPath string, opts ...Option) error {
+	var o = newOptions(opts)
+	var src, err = o.fs.OpenFile(oldPath, os.O_RDONLY, 0)
 	if err != nil {
 		return err
 	}
 	defer src.Close()
+	var info os.FileInfo
+	info, err = src.Stat()
+	if err != nil {
+		return err
+	}
+	var m = newMonitor(o, oldPath, info.Size())
+	if err = m.check(); err != nil {
+		return err
+	}
 
 	var dst *File
-	dst, err = CreateFileTmp(newPath)
+	dst, err = CreateFileTmp(newPath, opts...)
 	if err != nil {
 		return err
 	}
 	defer dst.RemoveIfTmp()
 
-	_, err = io.Copy(dst, src)
+	err = dst.copyFrom(src, newOptions(opts), m)
+	if err == nil {
+		err = dst.Close()
+	}
+	if err == nil {
+		m.finish()
+	}
+	return err
+}
+
+// copyFrom replaces the contents of the file by the contents of src and copies metadata as specified by the options.
+// The copy is monitored by m.
+func (f *File) copyFrom(src FSFile, o options, m *monitor) error {
+	var info, err = src.Stat()
+	if err != nil {
+		return err
+	}
+	var strategy CopyStrategy
+	strategy, err = f.copyData(src, info.Size(), o.preserveSparse, m)
 	if err != nil {
 		return err
 	}
-	return dst.Finalize()
+	if o.copyStrategy != nil {
+		*o.copyStrategy = strategy
+	}
+
+	if o.preservePermissions {
+		err = f.chmod(info.Mode())
+		if err != nil {
+			return err
+		}
+	}
+	if o.preserveXattrs {
+		err = f.withFile(func(dst FSFile) error {
+			var osDst, err = osFile(dst)
+			if err != nil {
+				return err
+			}
+			var osSrc *os.File
+			osSrc, err = osFile(src)
+			if err != nil {
+				return err
+			}
+			return copyXattrs(osDst, osSrc)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if o.preserveTimes {
+		// the data must be flushed before setting the modification time, but only synced if required by the durability
+		f.mutex.Lock()
+		err = f.syncDurable()
+		f.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		return f.chtimes(fileAtime(info), info.ModTime())
+	}
+	return nil
+}
+
+// copyData replaces the contents of the file by the first size bytes of src, checking for cancellation and reporting
+// the progress to m between chunks.
+func (f *File) copyData(src FSFile, size int64, sparse bool, m *monitor) (CopyStrategy, error) {
+	f.mutex.RLock()
+	var encoded = f.encoded()
+	f.mutex.RUnlock()
+	if encoded {
+		var _, err = io.Copy(f, monitoredReader{io.NewSectionReader(src, 0, size), m})
+		return CopyBuffered, err
+	}
+	var strategy CopyStrategy
+	var err = f.withFile(func(dst FSFile) error {
+		var err = dst.Truncate(0)
+		if err != nil {
+			return err
+		}
+		var osDst, dstOk = dst.(*os.File)
+		var osSrc, srcOk = src.(*os.File)
+		if dstOk && srcOk {
+			strategy, err = copyFast(osDst, osSrc, size, sparse, m)
+		} else {
+			strategy, err = CopyBuffered, copyBuffered(dst, src, 0, size, m)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = dst.Seek(0, io.SeekEnd)
+		return err
+	})
+	return strategy, err
+}
+
+// withFile calls fn with the underlying file after emptying the buffers. The file must not be closed by fn.
+func (f *File) withFile(fn func(file FSFile) error) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.ifClosedError(); err != nil {
+		return err
+	}
+	if err := f.ifEncodedError(); err != nil {
+		return err
+	}
+	f.invalidateChecksum()
+	if err := f.emptyBuffers(); err != nil {
+		return err
+	}
+	return fn(f.file)
+}
+
+// copyBuffered copies n bytes at offset off from src to dst through a buffer, which is monitored by m.
+func copyBuffered(dst io.WriterAt, src io.ReaderAt, off, n int64, m *monitor) error {
+	var _, err = io.Copy(&offsetWriter{dst, off}, monitoredReader{io.NewSectionReader(src, off, n), m})
+	return err
+}
+
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (w *offsetWriter) Write(b []byte) (int, error) {
+	var n, err = w.w.WriteAt(b, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// PreservePermissions makes Copy and CopyDir keep the permission bits of copied files. Move always keeps them.
+func PreservePermissions() Option {
+	return func(o *options) {
+		o.preservePermissions = true
+	}
+}
+
+// PreserveTimes makes Copy and CopyDir keep the access and modification times of copied files. Move always keeps
+// the modification time.
+func PreserveTimes() Option {
+	return func(o *options) {
+		o.preserveTimes = true
+	}
+}
+
+// PreserveXattrs makes Copy and CopyDir keep the extended attributes of copied files.
+func PreserveXattrs() Option {
+	return func(o *options) {
+		o.preserveXattrs = true
+	}
+}
+
+// PreserveSparse makes Copy and CopyDir keep holes in sparse files, instead of filling them with zeros.
+func PreserveSparse() Option {
+	return func(o *options) {
+		o.preserveSparse = true
+	}
+}
+
+// ReportCopyStrategy makes Copy store the strategy that was used in s.
+func ReportCopyStrategy(s *CopyStrategy) Option {
+	return func(o *options) {
+		o.copyStrategy = s
+	}
 }
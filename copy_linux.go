@@ -0,0 +1,154 @@
+//go:build linux
+// +build linux
+
+package fileutils
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ficlone  = 0x40049409
+	seekData = 3
+	seekHole = 4
+)
+
+// copyFast copies size bytes from src to the empty dst using the fastest supported strategy.
+// Except for reflinks, the data is copied in chunks, which are monitored by m.
+func copyFast(dst, src *os.File, size int64, sparse bool, m *monitor) (CopyStrategy, error) {
+	if unix.IoctlSetInt(int(dst.Fd()), ficlone, int(src.Fd())) == nil {
+		return CopyReflink, nil
+	}
+	if !sparse {
+		return copyRange(dst, src, 0, size, CopyFileRange, m)
+	}
+
+	var strategy = CopyFileRange
+	var off int64
+	for off < size {
+		var dataStart, err = unix.Seek(int(src.Fd()), off, seekData)
+		if err == unix.ENXIO {
+			break
+		} else if err == unix.EINVAL {
+			// holes are not supported by the filesystem
+			return copyRange(dst, src, off, size-off, strategy, m)
+		} else if err != nil {
+			return strategy, os.NewSyscallError("lseek", err)
+		}
+		var holeStart int64
+		holeStart, err = unix.Seek(int(src.Fd()), dataStart, seekHole)
+		if err != nil {
+			return strategy, os.NewSyscallError("lseek", err)
+		}
+		if holeStart > size {
+			holeStart = size
+		}
+		strategy, err = copyRange(dst, src, dataStart, holeStart-dataStart, strategy, m)
+		if err != nil {
+			return strategy, err
+		}
+		off = holeStart
+	}
+	return strategy, dst.Truncate(size)
+}
+
+// copyRange copies n bytes at offset off from src to dst, starting with the specified strategy and falling back to
+// slower ones if necessary. The strategy that was used last is returned.
+func copyRange(dst, src *os.File, off, n int64, strategy CopyStrategy, m *monitor) (CopyStrategy, error) {
+	var end = off + n
+	for off < end && strategy == CopyFileRange {
+		if err := m.check(); err != nil {
+			return strategy, err
+		}
+		var srcOff, dstOff = off, off
+		var written, err = unix.CopyFileRange(int(src.Fd()), &srcOff, int(dst.Fd()), &dstOff,
+			int(min64(end-off, contextChunkSize)), 0)
+		if isUnsupported(err) {
+			strategy = CopySendfile
+			break
+		} else if err != nil {
+			return strategy, os.NewSyscallError("copy_file_range", err)
+		} else if written == 0 {
+			return strategy, nil
+		}
+		off += int64(written)
+		m.advance(int64(written))
+	}
+	if off < end && strategy == CopySendfile {
+		var _, err = dst.Seek(off, 0)
+		if err != nil {
+			return strategy, err
+		}
+	}
+	for off < end && strategy == CopySendfile {
+		if err := m.check(); err != nil {
+			return strategy, err
+		}
+		var written, err = unix.Sendfile(int(dst.Fd()), int(src.Fd()), &off, int(min64(end-off, contextChunkSize)))
+		if isUnsupported(err) {
+			strategy = CopyBuffered
+			break
+		} else if err != nil {
+			return strategy, os.NewSyscallError("sendfile", err)
+		} else if written == 0 {
+			return strategy, nil
+		}
+		m.advance(int64(written))
+	}
+	if off < end {
+		return CopyBuffered, copyBuffered(dst, src, off, end-off, m)
+	}
+	return strategy, nil
+}
+
+func isUnsupported(err error) bool {
+	return err == unix.ENOSYS || err == unix.EXDEV || err == unix.EINVAL || err == unix.EOPNOTSUPP
+}
+
+func copyXattrs(dst, src *os.File) error {
+	var size, err = unix.Flistxattr(int(src.Fd()), nil)
+	if err == unix.EOPNOTSUPP || (err == nil && size == 0) {
+		return nil
+	} else if err != nil {
+		return os.NewSyscallError("flistxattr", err)
+	}
+	var names = make([]byte, size)
+	size, err = unix.Flistxattr(int(src.Fd()), names)
+	if err != nil {
+		return os.NewSyscallError("flistxattr", err)
+	}
+	var start = 0
+	for i, c := range names[:size] {
+		if c != 0 {
+			continue
+		}
+		var name = string(names[start:i])
+		start = i + 1
+		var valueSize int
+		valueSize, err = unix.Fgetxattr(int(src.Fd()), name, nil)
+		if err != nil {
+			return os.NewSyscallError("fgetxattr", err)
+		}
+		var value = make([]byte, valueSize)
+		valueSize, err = unix.Fgetxattr(int(src.Fd()), name, value)
+		if err != nil {
+			return os.NewSyscallError("fgetxattr", err)
+		}
+		err = unix.Fsetxattr(int(dst.Fd()), name, value[:valueSize], 0)
+		if err != nil {
+			return os.NewSyscallError("fsetxattr", err)
+		}
+	}
+	return nil
+}
+
+func fileAtime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atim.Unix())
+	}
+	return info.ModTime()
+}
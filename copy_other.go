@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package fileutils
+
+import (
+	"os"
+	"time"
+
+	"github.com/infobaleen/errors"
+)
+
+func copyFast(dst, src *os.File, size int64, sparse bool, m *monitor) (CopyStrategy, error) {
+	return CopyBuffered, copyBuffered(dst, src, 0, size, m)
+}
+
+func copyXattrs(dst, src *os.File) error {
+	return errors.Fmt("extended attributes are not supported on this platform")
+}
+
+func fileAtime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,180 @@
+package fileutils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/infobaleen/errors"
+)
+
+// SymlinkPolicy controls how CopyDir handles symbolic links.
+type SymlinkPolicy int
+
+const (
+	// SymlinksCopy creates symbolic links with the same target in the copy.
+	SymlinksCopy SymlinkPolicy = iota
+	// SymlinksFollow copies the files and directories that symbolic links point to.
+	SymlinksFollow
+	// SymlinksSkip leaves out symbolic links.
+	SymlinksSkip
+)
+
+// Symlinks sets how CopyDir handles symbolic links. The default is SymlinksCopy.
+func Symlinks(policy SymlinkPolicy) Option {
+	return func(o *options) {
+		o.symlinks = policy
+	}
+}
+
+// Include makes CopyDir only copy files that match at least one of the glob patterns (see filepath.Match).
+// Patterns that contain a slash are matched against the path relative to the copied directory,
+// others against the file name. Directories are always included, unless they are excluded.
+func Include(patterns ...string) Option {
+	return func(o *options) {
+		o.include = append(o.include, patterns...)
+	}
+}
+
+// Exclude makes CopyDir skip files and directories that match any of the glob patterns.
+// Patterns are matched like with Include.
+func Exclude(patterns ...string) Option {
+	return func(o *options) {
+		o.exclude = append(o.exclude, patterns...)
+	}
+}
+
+// CopyDir copies the directory tree at src to dst, which must not exist yet.
+// The copy is built in a temporary directory (see CreateDirTmp), that is only moved to dst if all files were copied
+// successfully.
+// Files are copied like with Copy, which also receives the options.
+func CopyDir(src, dst string, opts ...Option) error {
+	var o = newOptions(opts)
+	var info, err = o.fs.Stat(src)
+	if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return errors.Fmt("%q is not a directory", src)
+	}
+	var d *Dir
+	d, err = CreateDirTmp(dst, opts...)
+	if err != nil {
+		return err
+	}
+	defer d.RemoveIfTmp()
+	// the files are synced together with the directory when it is finalized
+	var c = dirCopier{opts: append(opts[:len(opts):len(opts)], WithDurability(DurabilityNone)), o: o}
+	err = c.copyDir(src, d.Path(), "", []os.FileInfo{info})
+	if err != nil {
+		return err
+	}
+	err = c.copyDirMetadata(d.Path(), info)
+	if err != nil {
+		return err
+	}
+	return d.FinalizeNoReplace()
+}
+
+type dirCopier struct {
+	opts []Option
+	o    options
+}
+
+// copyDir copies the contents of the directory src to dst. Parents contains the infos of src and its ancestors,
+// to detect loops when following symbolic links.
+func (c *dirCopier) copyDir(src, dst, rel string, parents []os.FileInfo) error {
+	var infos, err = c.o.fs.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		var name = info.Name()
+		var srcPath = filepath.Join(src, name)
+		var dstPath = filepath.Join(dst, name)
+		var relPath = filepath.ToSlash(filepath.Join(rel, name))
+		if c.excluded(relPath, name) {
+			continue
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch c.o.symlinks {
+			case SymlinksSkip:
+				continue
+			case SymlinksCopy:
+				var target string
+				target, err = c.o.fs.Readlink(srcPath)
+				if err == nil {
+					err = c.o.fs.Symlink(target, dstPath)
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			info, err = c.o.fs.Stat(srcPath)
+			if err != nil {
+				return err
+			}
+		}
+
+		if info.IsDir() {
+			for _, parent := range parents {
+				if sameFile(parent, info) {
+					return errors.Fmt("symbolic link loop at %q", srcPath)
+				}
+			}
+			err = c.o.fs.Mkdir(dstPath, 0777)
+			if err == nil {
+				err = c.copyDir(srcPath, dstPath, relPath, append(parents, info))
+			}
+			if err == nil {
+				err = c.copyDirMetadata(dstPath, info)
+			}
+		} else if info.Mode().IsRegular() {
+			if !c.included(relPath, name) {
+				continue
+			}
+			err = Copy(srcPath, dstPath, c.opts...)
+		} else {
+			err = errors.Fmt("%q is neither directory, regular file nor symbolic link", srcPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *dirCopier) copyDirMetadata(dst string, info os.FileInfo) error {
+	if c.o.preservePermissions {
+		var err = c.o.fs.Chmod(dst, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+	}
+	if c.o.preserveTimes {
+		return c.o.fs.Chtimes(dst, fileAtime(info), info.ModTime())
+	}
+	return nil
+}
+
+func (c *dirCopier) included(relPath, name string) bool {
+	return len(c.o.include) == 0 || matchAny(c.o.include, relPath, name)
+}
+
+func (c *dirCopier) excluded(relPath, name string) bool {
+	return matchAny(c.o.exclude, relPath, name)
+}
+
+func matchAny(patterns []string, relPath, name string) bool {
+	for _, pattern := range patterns {
+		var subject = name
+		if strings.Contains(pattern, "/") {
+			subject = relPath
+		}
+		if ok, _ := filepath.Match(pattern, subject); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package fileutils
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/infobaleen/errors"
+)
+
+// Dir is a directory that is created under a temporary name and moved into place once it is complete,
+// so that readers never see a partially populated directory. For example:
+//
+//	d, err := CreateDirTmp("data")
+//	...
+//	defer d.RemoveIfTmp()
+//	err = WriteTaggedStructFiles(d.Path(), v)
+//	...
+//	err = d.Finalize()
+type Dir struct {
+	mutex      sync.Mutex
+	fs         FS
+	path       string
+	target     string
+	tmp        bool
+	durability Durability
+}
+
+// CreateDirTmp creates a temporary directory that is moved to path by Finalize.
+// It is created next to path and named according to the TmpPattern option.
+func CreateDirTmp(path string, opts ...Option) (*Dir, error) {
+	var o = newOptions(opts)
+	var err error
+	path, err = absPath(o.fs, path)
+	if err != nil {
+		return nil, err
+	}
+	var dir = o.tmpDir
+	if dir == "" {
+		dir = filepath.Dir(path)
+	}
+	var d = Dir{fs: o.fs, target: path, tmp: true, durability: o.durability}
+	d.path, err = createNamedTmpDir(o.fs, dir, o.tmpPattern, path, 0777)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// createNamedTmpDir creates a temporary directory in dir for the target path, following the pattern (see TmpPattern).
+func createNamedTmpDir(fs FS, dir, pattern, target string, perm os.FileMode) (string, error) {
+	var err = os.ErrExist
+	var name string
+	for i := 0; i < 100 && os.IsExist(err); i++ {
+		name = tmpName(dir, pattern, target)
+		err = fs.Mkdir(name, perm)
+	}
+	return name, err
+}
+
+// Path returns the current path of the directory.
+func (d *Dir) Path() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.path
+}
+
+// Finalize moves a temporary directory to its final path. An existing directory at that path is only replaced if it
+// is empty. Depending on the durability, the contents of the directory are synced to disk before.
+func (d *Dir) Finalize() error {
+	return d.finalizeWith(func() error {
+		return d.fs.Rename(d.path, d.target)
+	})
+}
+
+// FinalizeNoReplace is like Finalize, but fails if the destination already exists.
+// In that case os.IsExist reports true for the returned error and the directory remains temporary.
+func (d *Dir) FinalizeNoReplace() error {
+	return d.finalizeWith(func() error {
+		return renameNoReplace(d.fs, d.path, d.target)
+	})
+}
+
+// FinalizeExchange is like Finalize, but atomically swaps the directory with the existing directory at the destination.
+// The previous contents are returned as a temporary Dir with the same destination,
+// which can be finalized to roll back the change or removed with RemoveIfTmp.
+func (d *Dir) FinalizeExchange() (*Dir, error) {
+	var oldPath string
+	var err = d.finalizeWith(func() error {
+		oldPath = d.path
+		return renameExchange(d.fs, d.path, d.target)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Dir{fs: d.fs, path: oldPath, target: d.target, tmp: true, durability: d.durability}, nil
+}
+
+func (d *Dir) finalizeWith(place func() error) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.tmp {
+		return errors.Fmt("directory %q is not temporary", d.path)
+	}
+	var err = syncTree(d.fs, d.path, d.durability)
+	if err != nil {
+		return err
+	}
+	var tmpParent = filepath.Dir(d.path)
+	err = place()
+	if err != nil {
+		return err
+	}
+	d.path = d.target
+	d.tmp = false
+	if d.durability >= DurabilityFull {
+		err = syncDir(d.fs, filepath.Dir(d.path))
+		if err == nil && tmpParent != filepath.Dir(d.path) {
+			err = syncDir(d.fs, tmpParent)
+		}
+	}
+	return err
+}
+
+// RemoveIfTmp removes the directory and its contents if it is temporary.
+func (d *Dir) RemoveIfTmp() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.tmp {
+		return nil
+	}
+	var err = removeAll(d.fs, d.path)
+	if err != nil {
+		return errors.Fmt("removal of partial directory failed: %v", err.Error())
+	}
+	d.tmp = false
+	return nil
+}
+
+// syncTree syncs the regular files in a directory tree if durability is at least DurabilityData
+// and the directories if it is DurabilityFull.
+func syncTree(fs FS, dir string, durability Durability) error {
+	if durability < DurabilityData {
+		return nil
+	}
+	var infos, err = fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		var path = filepath.Join(dir, info.Name())
+		if info.IsDir() {
+			err = syncTree(fs, path, durability)
+		} else if info.Mode().IsRegular() {
+			err = syncFile(fs, path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if durability >= DurabilityFull {
+		return syncDir(fs, dir)
+	}
+	return nil
+}
+
+func syncFile(fs FS, path string) error {
+	var f, err = fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return errors.WithAftermath(err, f.Close())
+	}
+	return f.Close()
+}
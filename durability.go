@@ -0,0 +1,29 @@
+package fileutils
+
+// Durability controls how much is synced to disk before temporary files are finalized.
+type Durability int
+
+const (
+	// DurabilityNone only flushes buffered data to the operating system. Close doesn't sync files with this
+	// durability, so the data may be lost if the system crashes.
+	DurabilityNone Durability = iota
+	// DurabilityData syncs the file contents before a temporary file is renamed into place.
+	DurabilityData
+	// DurabilityFull additionally syncs the parent directory after the rename, so the new name survives a crash.
+	DurabilityFull
+)
+
+// DefaultDurability is used for files that are created or opened afterwards.
+var DefaultDurability = DurabilityFull
+
+// SetDurability changes the durability of the file. See Durability for details.
+func (f *File) SetDurability(d Durability) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.durability = d
+}
+
+// syncDir makes changes to the entries of a directory durable.
+func syncDir(fs FS, dir string) error {
+	return fs.SyncDir(dir)
+}
@@ -0,0 +1,277 @@
+package fileutils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/infobaleen/errors"
+)
+
+// ErrDecryption is the cause of errors returned when an encrypted file can't be decrypted, because it is truncated,
+// was modified or was encrypted with another key, or when a file that should be encrypted isn't.
+const ErrDecryption = constError("decryption failed")
+
+// ErrEncrypted is the cause of errors returned by operations that are not supported for encrypted files, like
+// Seek, ReadAt and WriteAt.
+const ErrEncrypted = constError("file is encrypted")
+
+// Encrypted files start with a header, which is authenticated together with every chunk:
+//
+//	magic (6 bytes) | key id length (uint16) | key id | chunk size (uint32) | nonce prefix (7 bytes)
+//
+// It is followed by chunks of the plaintext, each sealed with AES-GCM. All chunks except the last one contain
+// exactly chunk size bytes of plaintext. The nonce of each chunk consists of the random prefix, the index of the chunk
+// (uint32) and a byte that is 1 for the last chunk, so truncation, reordering and tampering are detected.
+const (
+	encryptionMagic     = "FUENC\x01"
+	encryptionChunkSize = 64 << 10
+	maxChunkSize        = 16 << 20
+	noncePrefixSize     = 7
+)
+
+// KeyProvider supplies the keys to encrypt and decrypt files. The keys must be 16, 24 or 32 bytes long to select
+// AES-128, AES-192 or AES-256. Implementations must be safe to call concurrently.
+type KeyProvider interface {
+	// EncryptionKey returns the key used to encrypt new files and its id, which is stored in their header.
+	EncryptionKey() (id string, key []byte, err error)
+	// DecryptionKey returns the key with the id read from the header of an encrypted file.
+	DecryptionKey(id string) ([]byte, error)
+}
+
+// StaticKey returns a KeyProvider that only knows a single key.
+func StaticKey(id string, key []byte) KeyProvider {
+	return staticKey{id, key}
+}
+
+type staticKey struct {
+	id  string
+	key []byte
+}
+
+func (k staticKey) EncryptionKey() (string, []byte, error) {
+	return k.id, k.key, nil
+}
+
+func (k staticKey) DecryptionKey(id string) ([]byte, error) {
+	if id != k.id {
+		return nil, errors.Fmt("unknown key id %q", id)
+	}
+	return k.key, nil
+}
+
+// Encrypt makes created files (see CreateFileTmp) and the writing functions encrypt the contents with a key of the
+// provider, and the reading functions like ReadFile decrypt them. Compressed files are compressed before they are
+// encrypted. The reading functions fail for files that are not encrypted, so they can't be replaced by forged
+// plaintext. Like for compression, encrypted files are write-only, the encryption is completed when they are
+// finalized and Sync doesn't write the last incomplete chunk. Files opened with OpenFile are never decrypted.
+func Encrypt(keys KeyProvider) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+// streamNonce returns the nonce of a chunk.
+func streamNonce(prefix []byte, index uint32, last bool) []byte {
+	var nonce = make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	var block, err = aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptWriter encrypts everything written to it in chunks. Close seals the last chunk.
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	index   uint32
+	chunk   []byte // plaintext of the current chunk
+	written bool   // whether the header was written
+	closed  bool
+}
+
+func newEncryptWriter(w io.Writer, keys KeyProvider) (*encryptWriter, error) {
+	var id, key, err = keys.EncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(id) > 0xffff {
+		return nil, errors.Fmt("key id is too long")
+	}
+	var e = &encryptWriter{w: w, chunk: make([]byte, 0, encryptionChunkSize)}
+	e.aead, err = newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	e.prefix = make([]byte, noncePrefixSize)
+	_, err = rand.Read(e.prefix)
+	if err != nil {
+		return nil, err
+	}
+	var header = bytes.NewBufferString(encryptionMagic)
+	_ = binary.Write(header, binary.BigEndian, uint16(len(id)))
+	header.WriteString(id)
+	_ = binary.Write(header, binary.BigEndian, uint32(encryptionChunkSize))
+	header.Write(e.prefix)
+	e.header = header.Bytes()
+	return e, nil
+}
+
+func (e *encryptWriter) Write(b []byte) (int, error) {
+	if e.closed {
+		return 0, errors.Fmt("encryption is already completed")
+	}
+	var n int
+	for len(b) > 0 {
+		if len(e.chunk) == cap(e.chunk) {
+			// a full chunk is only sealed once more data follows, because the last chunk is sealed differently
+			if err := e.seal(false); err != nil {
+				return n, err
+			}
+		}
+		var c = copy(e.chunk[len(e.chunk):cap(e.chunk)], b)
+		e.chunk = e.chunk[:len(e.chunk)+c]
+		b = b[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// seal encrypts and writes the current chunk.
+func (e *encryptWriter) seal(last bool) error {
+	if !e.written {
+		if _, err := e.w.Write(e.header); err != nil {
+			return err
+		}
+		e.written = true
+	}
+	if !last && e.index == 1<<32-1 {
+		return errors.Fmt("encrypted file is too large")
+	}
+	var sealed = e.aead.Seal(nil, streamNonce(e.prefix, e.index, last), e.chunk, e.header)
+	e.index++
+	e.chunk = e.chunk[:0]
+	var _, err = e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+// decryptReader decrypts a stream written by encryptWriter and fails if it was truncated or modified.
+type decryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+	index  uint32
+	sealed []byte // buffer for sealed chunks
+	plain  []byte // unread plaintext of the current chunk
+	last   bool   // whether the last chunk was read
+	err    error  // returned by all reads after a chunk failed
+}
+
+// decryptingReader returns a reader for the plaintext of an encrypted file, which fails for files that are not
+// encrypted. If keys is nil, the file is not decrypted and r is returned.
+func decryptingReader(r io.Reader, name string, keys KeyProvider) (io.Reader, bool, error) {
+	if keys == nil {
+		return r, false, nil
+	}
+	var br = bufio.NewReader(r)
+	var magic, _ = br.Peek(len(encryptionMagic))
+	if string(magic) != encryptionMagic {
+		return nil, false, errors.Wrap(ErrDecryption, "file %q is not encrypted", name)
+	}
+
+	var header = bytes.NewBuffer(nil)
+	var tr = io.TeeReader(br, header)
+	var fields struct {
+		Magic [len(encryptionMagic)]byte
+		IDLen uint16
+	}
+	var err = binary.Read(tr, binary.BigEndian, &fields)
+	var id = make([]byte, fields.IDLen)
+	if err == nil {
+		_, err = io.ReadFull(tr, id)
+	}
+	var chunkSize uint32
+	if err == nil {
+		err = binary.Read(tr, binary.BigEndian, &chunkSize)
+	}
+	var prefix = make([]byte, noncePrefixSize)
+	if err == nil {
+		_, err = io.ReadFull(tr, prefix)
+	}
+	if err == nil && (chunkSize == 0 || chunkSize > maxChunkSize) {
+		err = errors.Fmt("invalid chunk size %d", chunkSize)
+	}
+	if err != nil {
+		return nil, true, errors.Wrap(ErrDecryption, "invalid header of %q: %v", name, err)
+	}
+
+	var key []byte
+	key, err = keys.DecryptionKey(string(id))
+	if err != nil {
+		return nil, true, err
+	}
+	var d = &decryptReader{r: br, header: header.Bytes(), prefix: prefix}
+	d.aead, err = newGCM(key)
+	if err != nil {
+		return nil, true, err
+	}
+	d.sealed = make([]byte, int(chunkSize)+d.aead.Overhead())
+	return d, true, nil
+}
+
+func (d *decryptReader) Read(b []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		} else if d.last {
+			return 0, io.EOF
+		}
+		d.err = d.open()
+	}
+	var n = copy(b, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (d *decryptReader) open() error {
+	var n, err = io.ReadFull(d.r, d.sealed)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		d.last = true
+	} else if err != nil {
+		return err
+	} else if _, err = d.r.Peek(1); err == io.EOF {
+		d.last = true
+	}
+	d.plain, err = d.aead.Open(d.sealed[:0], streamNonce(d.prefix, d.index, d.last), d.sealed[:n], d.header)
+	if err != nil {
+		return errors.Wrap(ErrDecryption, "chunk %d is truncated or was modified", d.index)
+	}
+	d.index++
+	return nil
+}
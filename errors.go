@@ -0,0 +1,23 @@
+package fileutils
+
+import "github.com/infobaleen/errors"
+
+// constError allows declaring errors as constants, so they can be compared to the cause of returned errors.
+type constError string
+
+func (err constError) Error() string {
+	return string(err)
+}
+
+// appendError combines errors, keeping the cause of the first one. It is used instead of errors.WithAnother,
+// which duplicates another if err is nil and returns errors that can't be formatted.
+func appendError(err error, another ...error) error {
+	for _, a := range another {
+		if err == nil {
+			err = a
+		} else if a != nil {
+			err = errors.WithAftermath(err, a)
+		}
+	}
+	return err
+}
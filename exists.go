@@ -2,8 +2,8 @@ package fileutils
 
 import "os"
 
-func Exists(path string) (bool, error) {
-	var _, err = os.Stat(path)
+func Exists(path string, opts ...Option) (bool, error) {
+	var _, err = newOptions(opts).fs.Stat(path)
 	if os.IsNotExist(err) {
 		return false, nil
 	} else if err != nil {
@@ -0,0 +1,389 @@
+package fileutils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/infobaleen/errors"
+)
+
+// ErrCrashed is the cause of errors returned by a FaultFS after a simulated crash.
+const ErrCrashed = constError("filesystem crashed")
+
+// FaultOp describes an operation of a FaultFS. Operations are numbered from 0 in the order they are started.
+type FaultOp struct {
+	N    int
+	Name string
+	Path string
+}
+
+func (op FaultOp) String() string {
+	return fmt.Sprintf("%d (%s %q)", op.N, op.Name, op.Path)
+}
+
+// Fault describes how an operation of a FaultFS fails.
+type Fault struct {
+	// Err is returned by the operation instead of performing it, for example syscall.ENOSPC or syscall.EIO.
+	Err error
+	// Short makes writes write only half of the data before returning Err, or io.ErrShortWrite if Err is nil.
+	Short bool
+	// Crash crashes the filesystem before the operation, which then fails like all later operations with an error
+	// caused by ErrCrashed. The underlying filesystem is crashed too, if it has a Crash method like MemFS.
+	Crash bool
+}
+
+// FaultFS wraps a filesystem, usually a MemFS, and injects faults into its operations, which include the methods of
+// opened files. It is intended for testing how code behaves if the disk is full, fails or loses power.
+type FaultFS struct {
+	fs      FS
+	mutex   sync.Mutex
+	ops     []FaultOp
+	inject  func(op FaultOp) *Fault
+	crashed bool
+}
+
+// NewFaultFS returns a FaultFS that performs operations on fs and doesn't inject faults until told to.
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{fs: fs}
+}
+
+// Inject sets a function that decides for every operation whether it fails, by returning a non-nil Fault.
+func (fs *FaultFS) Inject(fn func(op FaultOp) *Fault) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.inject = fn
+}
+
+// InjectAt makes the operation with the number n fail with the fault.
+func (fs *FaultFS) InjectAt(n int, fault Fault) {
+	fs.Inject(func(op FaultOp) *Fault {
+		if op.N == n {
+			return &fault
+		}
+		return nil
+	})
+}
+
+// Ops returns the operations that were started so far.
+func (fs *FaultFS) Ops() []FaultOp {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return append([]FaultOp(nil), fs.ops...)
+}
+
+// Crashed reports whether a crash was injected.
+func (fs *FaultFS) Crashed() bool {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.crashed
+}
+
+// start records an operation and returns the fault to inject, which is nil if the operation should be performed.
+func (fs *FaultFS) start(name, path string) *Fault {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var op = FaultOp{N: len(fs.ops), Name: name, Path: path}
+	fs.ops = append(fs.ops, op)
+	if fs.crashed {
+		return &Fault{Crash: true}
+	}
+	var fault *Fault
+	if fs.inject != nil {
+		fault = fs.inject(op)
+	}
+	if fault != nil && fault.Crash {
+		fs.crashed = true
+		if crasher, ok := fs.fs.(interface{ Crash() }); ok {
+			crasher.Crash()
+		}
+	}
+	return fault
+}
+
+// faultErr returns the error for a fault that is not a short write.
+func faultErr(fault *Fault, name, path string) error {
+	if fault.Crash {
+		return &os.PathError{Op: name, Path: path, Err: ErrCrashed}
+	} else if fault.Err == nil {
+		return nil
+	}
+	return &os.PathError{Op: name, Path: path, Err: fault.Err}
+}
+
+// do performs an operation that only returns an error, unless a fault is injected.
+func (fs *FaultFS) do(name, path string, fn func() error) error {
+	if fault := fs.start(name, path); fault != nil {
+		if err := faultErr(fault, name, path); err != nil {
+			return err
+		}
+	}
+	return fn()
+}
+
+func (fs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (FSFile, error) {
+	var file FSFile
+	var err = fs.do("open", name, func() error {
+		var err error
+		file, err = fs.fs.OpenFile(name, flag, perm)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{fs: fs, file: file}, nil
+}
+
+func (fs *FaultFS) Mkdir(name string, perm os.FileMode) error {
+	return fs.do("mkdir", name, func() error { return fs.fs.Mkdir(name, perm) })
+}
+
+func (fs *FaultFS) Rename(oldName, newName string) error {
+	return fs.do("rename", oldName, func() error { return fs.fs.Rename(oldName, newName) })
+}
+
+// RenameNoReplace renames a file and fails if the new name exists. It is emulated if the underlying filesystem
+// doesn't support it.
+func (fs *FaultFS) RenameNoReplace(oldName, newName string) error {
+	return fs.do("renamenoreplace", oldName, func() error { return renameNoReplace(fs.fs, oldName, newName) })
+}
+
+// RenameExchange atomically swaps the files at both paths, if the underlying filesystem supports it.
+func (fs *FaultFS) RenameExchange(oldName, newName string) error {
+	return fs.do("renameexchange", oldName, func() error { return renameExchange(fs.fs, oldName, newName) })
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	return fs.do("remove", name, func() error { return fs.fs.Remove(name) })
+}
+
+func (fs *FaultFS) Link(oldName, newName string) error {
+	return fs.do("link", oldName, func() error { return fs.fs.Link(oldName, newName) })
+}
+
+func (fs *FaultFS) Symlink(target, name string) error {
+	return fs.do("symlink", name, func() error { return fs.fs.Symlink(target, name) })
+}
+
+func (fs *FaultFS) Readlink(name string) (string, error) {
+	var target string
+	var err = fs.do("readlink", name, func() error {
+		var err error
+		target, err = fs.fs.Readlink(name)
+		return err
+	})
+	return target, err
+}
+
+func (fs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	var info os.FileInfo
+	var err = fs.do("stat", name, func() error {
+		var err error
+		info, err = fs.fs.Stat(name)
+		return err
+	})
+	return info, err
+}
+
+func (fs *FaultFS) Lstat(name string) (os.FileInfo, error) {
+	var info os.FileInfo
+	var err = fs.do("lstat", name, func() error {
+		var err error
+		info, err = fs.fs.Lstat(name)
+		return err
+	})
+	return info, err
+}
+
+func (fs *FaultFS) ReadDir(name string) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	var err = fs.do("readdir", name, func() error {
+		var err error
+		infos, err = fs.fs.ReadDir(name)
+		return err
+	})
+	return infos, err
+}
+
+func (fs *FaultFS) Chmod(name string, mode os.FileMode) error {
+	return fs.do("chmod", name, func() error { return fs.fs.Chmod(name, mode) })
+}
+
+func (fs *FaultFS) Chtimes(name string, atime, mtime time.Time) error {
+	return fs.do("chtimes", name, func() error { return fs.fs.Chtimes(name, atime, mtime) })
+}
+
+func (fs *FaultFS) SyncDir(name string) error {
+	return fs.do("syncdir", name, func() error { return fs.fs.SyncDir(name) })
+}
+
+// faultFile is a file opened by a FaultFS.
+type faultFile struct {
+	fs   *FaultFS
+	file FSFile
+}
+
+// write performs a write operation, which writes only half of the data for short write faults.
+func (f *faultFile) write(name string, b []byte, fn func(b []byte) (int, error)) (int, error) {
+	var fault = f.fs.start(name, f.file.Name())
+	if fault != nil && fault.Short && !fault.Crash {
+		var n, err = fn(b[:len(b)/2])
+		if err == nil {
+			err = fault.Err
+		}
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+		return n, err
+	} else if fault != nil {
+		if err := faultErr(fault, name, f.file.Name()); err != nil {
+			return 0, err
+		}
+	}
+	return fn(b)
+}
+
+func (f *faultFile) Write(b []byte) (int, error) {
+	return f.write("write", b, f.file.Write)
+}
+
+func (f *faultFile) WriteAt(b []byte, off int64) (int, error) {
+	return f.write("writeat", b, func(b []byte) (int, error) { return f.file.WriteAt(b, off) })
+}
+
+func (f *faultFile) Read(b []byte) (int, error) {
+	var n int
+	var err = f.fs.do("read", f.file.Name(), func() error {
+		var err error
+		n, err = f.file.Read(b)
+		return err
+	})
+	return n, err
+}
+
+func (f *faultFile) ReadAt(b []byte, off int64) (int, error) {
+	var n int
+	var err = f.fs.do("readat", f.file.Name(), func() error {
+		var err error
+		n, err = f.file.ReadAt(b, off)
+		return err
+	})
+	return n, err
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	var err = f.fs.do("seek", f.file.Name(), func() error {
+		var err error
+		pos, err = f.file.Seek(offset, whence)
+		return err
+	})
+	return pos, err
+}
+
+func (f *faultFile) Close() error {
+	return f.fs.do("close", f.file.Name(), f.file.Close)
+}
+
+func (f *faultFile) Name() string {
+	return f.file.Name()
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	var info os.FileInfo
+	var err = f.fs.do("fstat", f.file.Name(), func() error {
+		var err error
+		info, err = f.file.Stat()
+		return err
+	})
+	return info, err
+}
+
+func (f *faultFile) Sync() error {
+	return f.fs.do("fsync", f.file.Name(), f.file.Sync)
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	return f.fs.do("truncate", f.file.Name(), func() error { return f.file.Truncate(size) })
+}
+
+func (f *faultFile) Chmod(mode os.FileMode) error {
+	return f.fs.do("fchmod", f.file.Name(), func() error { return f.file.Chmod(mode) })
+}
+
+// CrashTest checks that a scenario is crash-consistent. The scenario is run on a FaultFS over a MemFS, once without
+// faults to count its operations, and then once for every operation with a crash injected before it.
+// Setup prepares a fresh MemFS for every run, which is made durable before the scenario starts.
+// After every crash, check is called with the MemFS in the state that survived the crash.
+// Errors of the scenario that are not caused by the crash are returned, like errors of setup and check, which are
+// annotated with the operation that the crash happened before.
+func CrashTest(setup func(fs FS) error, scenario func(fs FS) error, check func(fs FS) error) error {
+	var run = func(crashAt int) (*MemFS, []FaultOp, error) {
+		var mem = NewMemFS()
+		var err = setup(mem)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "setup failed")
+		}
+		mem.SyncAll()
+		var fs = NewFaultFS(mem)
+		if crashAt >= 0 {
+			fs.InjectAt(crashAt, Fault{Crash: true})
+		}
+		err = scenario(fs)
+		if err != nil && !fs.Crashed() {
+			return nil, nil, errors.Wrap(err, "scenario failed")
+		}
+		return mem, fs.Ops(), nil
+	}
+
+	var _, ops, err = run(-1)
+	if err != nil {
+		return err
+	}
+	for n := 0; n <= len(ops); n++ {
+		var mem *MemFS
+		mem, _, err = run(n)
+		if err != nil {
+			return err
+		}
+		if n == len(ops) {
+			// crash after the scenario finished
+			mem.Crash()
+		}
+		err = check(mem)
+		if err != nil && n < len(ops) {
+			return errors.Wrap(err, "check failed after crash before operation %s", ops[n])
+		} else if err != nil {
+			return errors.Wrap(err, "check failed after crash at the end")
+		}
+	}
+	return nil
+}
+
+// ExpectContent returns a check for CrashTest that the file at path has one of the expected contents.
+// A nil content means that the file must not exist, while an empty content means that the file must be empty.
+func ExpectContent(path string, contents ...[]byte) func(fs FS) error {
+	return func(fs FS) error {
+		var content, err = ReadFile(path, WithFS(fs))
+		if os.IsNotExist(err) {
+			content, err = nil, nil
+		} else if err == nil && content == nil {
+			content = []byte{}
+		}
+		if err != nil {
+			return err
+		}
+		for _, expected := range contents {
+			if (expected == nil) == (content == nil) && bytes.Equal(expected, content) {
+				return nil
+			}
+		}
+		if content == nil {
+			return errors.Fmt("%q doesn't exist", path)
+		}
+		return errors.Fmt("unexpected content of %q: %q", path, content)
+	}
+}
@@ -4,8 +4,9 @@ import (
 	"bufio"
 	"fmt"
 	"github.com/infobaleen/errors"
+	"io"
+	"io/fs"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -24,82 +25,195 @@ var rnd = func() func() uint16 {
 	}
 }()
 
+// File is a buffered file that can be created as a temporary file and atomically moved into place.
+// All methods are safe to call concurrently. Read, Write and Seek share the file offset and buffers,
+// so they are serialized, while concurrent calls of ReadAt don't block each other.
 type File struct {
-	mutex       sync.Mutex
+	mutex       sync.RWMutex
 	filepath    string
-	file        *os.File
+	target      string
+	fs          FS
+	file        FSFile
+	flag        int
 	tmp         bool
+	anonymous   bool
+	durability  Durability
+	tmpPattern  string
+	leakAction  LeakAction
+	observer    Observer
+	compressor  compressor     // compresses writes, if the file is compressed
+	encryptor   *encryptWriter // encrypts writes after compression, if the file is encrypted
+	checksum    *checksummer   // computes the checksum of created files, if enabled
+	stack       []uintptr      // where the file was created, if enabled with SetLeakDebug
+	locked      bool           // whether a lock was acquired by Lock, RLock, TryLock or TryRLock
 	onClose     []func() error
 	readBuffer  bufio.Reader
 	writeBuffer bufio.Writer
 }
 
 func (f *File) setFinalizer() {
-	runtime.SetFinalizer(f, func(h *File) {
-		if f.file != nil {
-			log.Println("GC found unclosed File, closing...")
-			var err = f.Close()
-			if err != nil {
-				log.Println("Error closing File:", err)
-			}
+	f.stack = leakStack()
+	runtime.SetFinalizer(f, func(f *File) {
+		if f.file == nil {
+			return
 		}
+		var leak = Leak{Type: "File", Path: f.filepath, Tmp: f.tmp, Action: f.leakAction, Stack: formatStack(f.stack)}
+		if f.tmp && f.leakAction == LeakRemove {
+			leak.Err = f.RemoveIfTmp()
+		} else {
+			leak.Err = f.Close()
+		}
+		reportLeak(leak)
 	})
 }
 
-func OpenFile(path string) (*File, error) {
-	var f File
+// OpenFile opens an existing file for reading and writing. The defaults can be changed with options.
+func OpenFile(path string, opts ...Option) (*File, error) {
+	var o = newOptions(opts)
+	var f = File{fs: o.fs, flag: o.flag, durability: o.durability, tmpPattern: o.tmpPattern, leakAction: o.leakAction,
+		observer: o.observer}
 	var err error
-	f.filepath, err = filepath.Abs(path)
+	f.filepath, err = absPath(o.fs, path)
 	if err != nil {
 		return nil, err
 	}
-	f.file, err = os.OpenFile(f.filepath, os.O_RDWR, 0666)
+	var start = time.Now()
+	f.file, err = o.fs.OpenFile(f.filepath, o.flag, o.perm)
+	observe(o.observer, Event{Kind: EventOpen, Path: f.filepath, Err: err}, start)
 	if err != nil {
 		return nil, err
 	}
-	f.initBuffers()
+	f.initBuffers(o)
 	f.setFinalizer()
 	return &f, nil
 }
 
-func CreateFile(path string) (*File, error) {
-	var f, err = CreateFileTmp(path)
+// CreateFile creates a file at path, replacing an existing file. Compressed and encrypted files can't be created with
+// it, because their streams are completed when they are finalized, so nothing could be written to them.
+func CreateFile(path string, opts ...Option) (*File, error) {
+	var f, err = CreateFileTmp(path, opts...)
 	if err != nil {
 		return nil, err
 	}
 	defer f.RemoveIfTmp()
-	err = f.Finalize()
+	err = f.ifEncodedError()
+	if err == nil {
+		err = f.Finalize()
+	}
 	if err != nil {
 		return nil, err
 	}
 	return f, nil
 }
 
-func CreateFileTmp(path string) (*File, error) {
-	// maybe O_TMPFILE should be used at some point in the future if portability improves
+// CreateFileTmp creates a temporary file that is moved to path by Finalize or Close.
+// Where the filesystem supports it, the file is created with O_TMPFILE and has no name until it is finalized,
+// so nothing is left behind if the process dies. Otherwise a sibling named "<path>.tmp<random>" is used.
+// The name and location of the temporary file can be changed with options.
+func CreateFileTmp(path string, opts ...Option) (*File, error) {
+	var o = newOptions(opts)
 	var err error
-	path, err = filepath.Abs(path)
+	path, err = absPath(o.fs, path)
+	if err != nil {
+		return nil, err
+	}
+	var dir = o.tmpDir
+	if dir == "" {
+		dir = filepath.Dir(path)
+	}
+	err = checkFreeSpace(o, dir)
 	if err != nil {
 		return nil, err
 	}
 
-	var f = File{tmp: true}
-	err = os.ErrExist
-	for i := 0; i < 100 && os.IsExist(err); i++ {
-		f.filepath = fmt.Sprintf("%s.tmp%d", path, rnd())
-		f.file, err = os.OpenFile(f.filepath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	var f = File{fs: o.fs, flag: os.O_RDWR, tmp: true, target: path, durability: o.durability, tmpPattern: o.tmpPattern,
+		leakAction: o.leakAction, observer: o.observer}
+	if o.checksum != ChecksumNone {
+		f.checksum = &checksummer{algorithm: o.checksum, placement: o.checksumPlacement, hash: o.checksum.newHash(),
+			valid: true}
+	}
+	if o.keys != nil {
+		f.encryptor, err = newEncryptWriter(fileIO{&f}, o.keys)
+		if err != nil {
+			return nil, errors.Wrap(err, "encrypting %q failed", path)
+		}
+	}
+	var start = time.Now()
+	if !o.namedTmp && o.fs == OSFS {
+		// Any failure of O_TMPFILE falls back to named files, since the reasons for refusing it vary between
+		// kernels and filesystems and real errors (e.g. missing directories) will be reported by the fallback.
+		f.file, err = openTmpfile(dir, o.perm)
+		f.anonymous = err == nil
 	}
+	if f.anonymous {
+		f.filepath = path
+	} else {
+		f.file, f.filepath, err = createNamedTmp(o.fs, dir, o.tmpPattern, path, o.perm)
+	}
+	observe(o.observer, Event{Kind: EventOpen, Path: f.filepath, Err: err}, start)
 	if err != nil {
 		return nil, err
 	}
-	f.initBuffers()
+	f.initBuffers(o)
+	var w io.Writer = fileIO{&f}
+	if f.encryptor != nil {
+		w = f.encryptor
+	}
+	if c := compressionFor(path, o.compression); c != CompressionNone {
+		f.compressor = newCompressor(c, w)
+		w = f.compressor
+	}
+	if f.encoded() {
+		f.writeBuffer.Reset(w)
+	}
 	f.setFinalizer()
 	return &f, nil
 }
 
-func (f *File) initBuffers() {
-	f.readBuffer = *bufio.NewReader(f.file)
-	f.writeBuffer = *bufio.NewWriter(f.file)
+// tmpName returns a random temporary name in dir for the target path, following the pattern (see TmpPattern).
+func tmpName(dir, pattern, target string) string {
+	return filepath.Join(dir, fmt.Sprintf(pattern, filepath.Base(target), rnd()))
+}
+
+func createNamedTmp(fs FS, dir, pattern, target string, perm os.FileMode) (FSFile, string, error) {
+	var err = os.ErrExist
+	var file FSFile
+	var name string
+	for i := 0; i < 100 && os.IsExist(err); i++ {
+		name = tmpName(dir, pattern, target)
+		file, err = fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	// keep CleanupTmpFiles from removing the file while it is in use
+	err = lockTmp(file)
+	if err != nil {
+		return nil, "", errors.WithAftermath(err, file.Close(), fs.Remove(name))
+	}
+	return file, name, nil
+}
+
+func (f *File) initBuffers(o options) {
+	var rw = f.bufferTarget()
+	if o.readBufferSize > 0 {
+		f.readBuffer = *bufio.NewReaderSize(rw, o.readBufferSize)
+	} else {
+		f.readBuffer = *bufio.NewReader(rw)
+	}
+	if o.writeBufferSize > 0 {
+		f.writeBuffer = *bufio.NewWriterSize(rw, o.writeBufferSize)
+	} else {
+		f.writeBuffer = *bufio.NewWriter(rw)
+	}
+}
+
+// bufferTarget returns what the buffers read from and write to.
+func (f *File) bufferTarget() io.ReadWriter {
+	if f.observer != nil || f.checksum != nil {
+		return fileIO{f}
+	}
+	return f.file
 }
 
 func (f *File) unreadReadBuffer() error {
@@ -115,7 +229,13 @@ func (f *File) unreadReadBuffer() error {
 }
 
 func (f *File) flushWriteBuffer() error {
-	return f.writeBuffer.Flush()
+	if err := f.writeBuffer.Flush(); err != nil {
+		return err
+	}
+	if f.compressor != nil {
+		return f.compressor.Flush()
+	}
+	return nil
 }
 
 func (f *File) emptyBuffers() error {
@@ -137,11 +257,15 @@ func (f *File) RemoveIfTmp() error {
 		return nil
 	}
 
-	var err = os.Remove(f.filepath)
-	if err != nil {
-		err = errors.Fmt("removal of partial file failed: %v", err.Error())
+	var err error
+	if !f.anonymous {
+		err = f.fs.Remove(f.filepath)
+		if err != nil {
+			err = errors.Fmt("removal of partial file failed: %v", err.Error())
+		}
 	}
-	err = errors.WithAnother(err, f.file.Close())
+	err = appendError(err, f.file.Close())
+	f.file = nil
 	return err
 }
 
@@ -152,10 +276,21 @@ func (f *File) ifClosedError() error {
 	return nil
 }
 
+func (f *File) isClosed() bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.file == nil
+}
+
 func (f *File) Read(b []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
 	if err := f.ifClosedError(); err != nil {
 		return 0, err
 	}
+	if err := f.ifEncodedError(); err != nil {
+		return 0, err
+	}
 	if err := f.flushWriteBuffer(); err != nil {
 		return 0, err
 	}
@@ -163,6 +298,8 @@ func (f *File) Read(b []byte) (int, error) {
 }
 
 func (f *File) Write(b []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
 	if err := f.ifClosedError(); err != nil {
 		return 0, err
 	}
@@ -172,9 +309,73 @@ func (f *File) Write(b []byte) (int, error) {
 	return f.writeBuffer.Write(b)
 }
 
+// ReadAt implements io.ReaderAt. It doesn't change the offset used by Read and Write and sees all preceding writes.
+// Concurrent calls of ReadAt don't block each other.
+func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	f.mutex.RLock()
+	for f.writeBuffer.Buffered() > 0 {
+		f.mutex.RUnlock()
+		var err = f.flushLocked()
+		if err != nil {
+			return 0, err
+		}
+		f.mutex.RLock()
+	}
+	defer f.mutex.RUnlock()
+	if err := f.ifClosedError(); err != nil {
+		return 0, err
+	}
+	if err := f.ifEncodedError(); err != nil {
+		return 0, err
+	}
+	var start = time.Now()
+	var n, err = f.file.ReadAt(b, off)
+	observe(f.observer, Event{Kind: EventRead, Path: f.filepath, Bytes: int64(n), Err: ignoreEOF(err)}, start)
+	return n, err
+}
+
+func (f *File) flushLocked() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.ifClosedError(); err != nil {
+		return err
+	}
+	return f.flushWriteBuffer()
+}
+
+// WriteAt implements io.WriterAt. It doesn't change the offset used by Read and Write.
+// Preceding buffered writes are flushed first and data that was buffered for Read is discarded.
+func (f *File) WriteAt(b []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.ifClosedError(); err != nil {
+		return 0, err
+	}
+	if err := f.ifEncodedError(); err != nil {
+		return 0, err
+	}
+	f.invalidateChecksum()
+	if err := f.emptyBuffers(); err != nil {
+		return 0, err
+	}
+	var start = time.Now()
+	var n, err = f.file.WriteAt(b, off)
+	observe(f.observer, Event{Kind: EventWrite, Path: f.filepath, Bytes: int64(n), Err: err}, start)
+	return n, err
+}
+
+// SetSize truncates or extends the file. Extended parts are holes on most filesystems, so writing them can still fail
+// for lack of space. Preallocate allocates them.
 func (f *File) SetSize(size int64) error {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
+	if err := f.ifClosedError(); err != nil {
+		return err
+	}
+	if err := f.ifEncodedError(); err != nil {
+		return err
+	}
+	f.invalidateChecksum()
 	if err := f.emptyBuffers(); err != nil {
 		return err
 	}
@@ -184,11 +385,17 @@ func (f *File) SetSize(size int64) error {
 func (f *File) Size() (int64, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
+	if err := f.ifClosedError(); err != nil {
+		return 0, err
+	}
 	if err := f.emptyBuffers(); err != nil {
 		return 0, err
 	}
 	var info, err = f.file.Stat()
-	return info.Size(), err
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
 }
 
 // Seek sets the byte offset of the next read or write. The whence argument controls how the offset is interpreted:
@@ -196,10 +403,14 @@ func (f *File) Size() (int64, error) {
 func (f *File) Seek(offset int64, whence int) (int64, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
-	if err := f.emptyBuffers(); err != nil {
+	if err := f.ifClosedError(); err != nil {
 		return 0, err
 	}
-	if err := f.ifClosedError(); err != nil {
+	if err := f.ifEncodedError(); err != nil {
+		return 0, err
+	}
+	f.invalidateChecksum()
+	if err := f.emptyBuffers(); err != nil {
 		return 0, err
 	}
 	return f.file.Seek(offset, whence)
@@ -214,12 +425,14 @@ func (f *File) Remove() error {
 
 	defer f.file.Close()
 	f.file = nil
-	return os.Remove(f.filepath)
+	return f.fs.Remove(f.filepath)
 }
 
+// Path returns the current path of the file.
+// Anonymous temporary files have no path yet, so the path they will have after Finalize is returned.
 func (f *File) Path() string {
-	f.mutex.Lock()
-	defer f.mutex.Unlock()
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
 	return f.filepath
 }
 
@@ -228,10 +441,12 @@ func (f *File) ChangeName(newName string) error {
 	defer f.mutex.Unlock()
 	if err := f.ifClosedError(); err != nil {
 		return err
+	} else if f.anonymous {
+		return errors.Fmt("can't rename anonymous temporary file")
 	}
 
 	var err error
-	f.filepath, err = ChangeName(f.filepath, newName)
+	f.filepath, err = ChangeName(f.filepath, newName, WithFS(f.fs))
 	return err
 }
 
@@ -242,15 +457,50 @@ func (f *File) Move(newPath string) error {
 	if err := f.ifClosedError(); err != nil {
 		return err
 	} else if f.tmp {
-		errors.Fmt("can't move temporary file")
+		return errors.Fmt("can't move temporary file")
 	}
 
-	var err error
-	f.filepath, err = Move(f.filepath, newPath)
+	if err := f.emptyBuffers(); err != nil {
+		return err
+	}
+	var copied, err = move(f.fs, f.observer, f.filepath, newPath)
+	if err != nil {
+		return err
+	}
+	f.filepath = newPath
+	if copied {
+		return f.reopen()
+	}
+	return nil
+}
+
+// reopen replaces the open file by the file currently found at its path, keeping the offset.
+func (f *File) reopen() error {
+	var offset, err = f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	var file FSFile
+	file, err = f.fs.OpenFile(f.filepath, f.flag&^(os.O_CREATE|os.O_EXCL|os.O_TRUNC), 0)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return errors.WithAftermath(err, file.Close())
+	}
+	err = f.file.Close()
+	f.file = file
+	f.readBuffer.Reset(f.bufferTarget())
+	if !f.encoded() {
+		f.writeBuffer.Reset(f.bufferTarget())
+	}
 	return err
 }
 
-// Finalize turns a temporary file into a non-temporary file
+// Finalize turns a temporary file into a non-temporary file.
+// Depending on the durability of the file, the contents and the directory entry are synced to disk,
+// so that the new file survives a crash once Finalize returns.
 func (f *File) Finalize() error {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
@@ -258,37 +508,230 @@ func (f *File) Finalize() error {
 		return err
 	}
 	if !f.tmp {
-		errors.Fmt("file %q is not temporary", f.filepath)
+		return errors.Fmt("file %q is not temporary", f.filepath)
 	}
 	return f.finalize()
 }
 
+// FinalizeNoReplace is like Finalize, but fails if the destination already exists.
+// In that case os.IsExist reports true for the returned error and the file remains temporary.
+func (f *File) FinalizeNoReplace() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.ifClosedError(); err != nil {
+		return err
+	}
+	if !f.tmp {
+		return errors.Fmt("file %q is not temporary", f.filepath)
+	}
+	return f.finalizeWith(f.placeNoReplace)
+}
+
+// FinalizeExchange is like Finalize, but atomically swaps the file with the existing file at the destination.
+// It requires a filesystem that implements RenameExchangeFS.
+// The previous contents are returned as a temporary File with the same destination,
+// which can be finalized to roll back the change or removed with RemoveIfTmp.
+func (f *File) FinalizeExchange() (*File, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.ifClosedError(); err != nil {
+		return nil, err
+	}
+	if !f.tmp {
+		return nil, errors.Fmt("file %q is not temporary", f.filepath)
+	}
+
+	var oldPath string
+	var err = f.finalizeWith(func() error {
+		oldPath = f.filepath
+		if f.anonymous {
+			var err = os.ErrExist
+			for i := 0; i < 100 && os.IsExist(err); i++ {
+				oldPath = tmpName(filepath.Dir(f.target), f.tmpPattern, f.target)
+				err = linkTmpfile(f.file.(*os.File), oldPath)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		var err = renameExchange(f.fs, oldPath, f.target)
+		if err != nil && f.anonymous {
+			err = errors.WithAftermath(err, f.fs.Remove(oldPath))
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var old *File
+	old, err = OpenFile(oldPath, WithFS(f.fs))
+	if err != nil {
+		return nil, err
+	}
+	err = lockTmp(old.file)
+	if err != nil {
+		return nil, errors.WithAftermath(err, old.Close())
+	}
+	old.tmp = true
+	old.target = f.target
+	old.durability = f.durability
+	old.tmpPattern = f.tmpPattern
+	old.leakAction = f.leakAction
+	old.observer = f.observer
+	return old, nil
+}
+
+// Sync flushes the buffers and commits the contents of the file to disk.
 func (f *File) Sync() error {
-	if err := f.emptyBuffers(); err != nil {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.ifClosedError(); err != nil {
 		return err
 	}
-	if err := f.file.Sync(); err != nil {
+	return f.sync()
+}
+
+func (f *File) sync() error {
+	if err := f.emptyBuffers(); err != nil {
 		return err
 	}
-	return nil
+	var start = time.Now()
+	var err = f.file.Sync()
+	observe(f.observer, Event{Kind: EventSync, Path: f.filepath, Err: err}, start)
+	return err
+}
+
+// syncDurable flushes the buffers and syncs the file if required by its durability.
+func (f *File) syncDurable() error {
+	if f.durability >= DurabilityData {
+		return f.sync()
+	}
+	return f.emptyBuffers()
 }
 
 func (f *File) finalize() error {
-	if f.tmp {
-		var err = f.Sync()
-		if err != nil {
-			return err
+	return f.finalizeWith(f.placeReplace)
+}
+
+// finalizeWith turns a temporary file into a non-temporary file, using place to move it to its target path.
+func (f *File) finalizeWith(place func() error) error {
+	if !f.tmp {
+		return nil
+	}
+	var sum []byte
+	var err = f.closeEncoders()
+	if err != nil {
+		return err
+	}
+	if f.checksum != nil {
+		err = f.emptyBuffers()
+		if err == nil {
+			sum, err = f.finishChecksum()
 		}
-		f.filepath, err = TrimName(f.filepath, "", filepath.Ext(f.filepath))
 		if err != nil {
 			return err
 		}
-		f.tmp = false
+	}
+	err = f.syncDurable()
+	if err != nil {
+		return err
+	}
+	var tmpDir = filepath.Dir(f.filepath)
+	var start = time.Now()
+	err = place()
+	observe(f.observer, Event{Kind: EventRename, Path: f.filepath, NewPath: f.target, Err: err}, start)
+	if err != nil {
+		return err
+	}
+	// the placed file no longer needs protection from CleanupTmpFiles
+	err = f.unlockTmp()
+	f.filepath = f.target
+	f.tmp = false
+	f.anonymous = false
+	if err == nil && f.durability >= DurabilityFull {
+		err = f.syncDir(filepath.Dir(f.filepath))
+		if err == nil && tmpDir != filepath.Dir(f.filepath) {
+			err = f.syncDir(tmpDir)
+		}
+	}
+	if err == nil && f.checksum != nil && f.checksum.placement == ChecksumSidecar {
+		err = f.writeSidecar(sum)
+	}
+	f.checksum = nil
+	return err
+}
+
+// syncDir syncs a directory of the file and reports it to the observer.
+func (f *File) syncDir(dir string) error {
+	var start = time.Now()
+	var err = syncDir(f.fs, dir)
+	observe(f.observer, Event{Kind: EventSync, Path: dir, Err: err}, start)
+	return err
+}
+
+func (f *File) placeReplace() error {
+	if f.anonymous {
+		return linkTmpfileReplace(f.file.(*os.File), f.tmpPattern, f.target)
+	}
+	return f.fs.Rename(f.filepath, f.target)
+}
+
+func (f *File) placeNoReplace() error {
+	if f.anonymous {
+		return linkTmpfile(f.file.(*os.File), f.target)
+	}
+	return renameNoReplace(f.fs, f.filepath, f.target)
+}
+
+// linkTmpfileReplace gives an anonymous file the specified path, replacing any existing file.
+func linkTmpfileReplace(file *os.File, pattern, path string) error {
+	var err = linkTmpfile(file, path)
+	if !os.IsExist(err) {
+		return err
+	}
+	// linkat never replaces, so link to an unused name first and rename that over the existing file
+	var name string
+	err = os.ErrExist
+	for i := 0; i < 100 && os.IsExist(err); i++ {
+		name = tmpName(filepath.Dir(path), pattern, path)
+		err = linkTmpfile(file, name)
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(name, path); err != nil {
+		return errors.WithAftermath(err, os.Remove(name))
 	}
 	return nil
 }
 
+func (f *File) chmod(mode os.FileMode) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.ifClosedError(); err != nil {
+		return err
+	}
+	return f.file.Chmod(mode)
+}
+
+func (f *File) chtimes(atime, mtime time.Time) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.ifClosedError(); err != nil {
+		return err
+	}
+	if f.anonymous {
+		return os.Chtimes(procFdPath(f.file.(*os.File)), atime, mtime)
+	}
+	return f.fs.Chtimes(f.filepath, atime, mtime)
+}
+
 // Close finalizes the file if it is temporary and closes it.
+// Depending on the durability of the file, the contents and the directory entry are synced to disk first.
+// With DurabilityNone, the file is not synced at all, even if it is not temporary.
+// If finalizing fails, a named temporary file is removed, because it could neither be finalized nor removed once the
+// file is closed. All errors are returned, with the cause of the first one.
 func (f *File) Close() error {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
@@ -296,29 +739,38 @@ func (f *File) Close() error {
 		return err
 	}
 	var err = f.finalize()
-	err = errors.WithAnother(err, f.Sync())
+	err = appendError(err, f.syncDurable())
 	for len(f.onClose) > 0 {
 		var fn = f.onClose[len(f.onClose)-1]
 		f.onClose = f.onClose[:len(f.onClose)-1]
-		err = errors.WithAnother(err, fn())
+		err = appendError(err, fn())
+	}
+	err = appendError(err, f.file.Close())
+	if f.tmp && !f.anonymous {
+		// finalizing failed, so the partial file is removed like by RemoveIfTmp
+		err = appendError(err, f.fs.Remove(f.filepath))
 	}
-	err = errors.WithAnother(err, f.file.Close())
 	f.file = nil
 	return err
 }
 
-func ReadFile(filename string) ([]byte, error) {
-	var file, err = os.Open(filename)
+func ReadFile(filename string, opts ...Option) ([]byte, error) {
+	return ReadFileFS(toIOFS(opts), filename, opts...)
+}
+
+// ReadFileFS is like ReadFile, but reads from fsys, for example an embed.FS.
+func ReadFileFS(fsys fs.FS, name string, opts ...Option) ([]byte, error) {
+	var file, r, _, err = openDecoded(fsys, name, opts)
 	if err != nil {
 		return nil, err
 	}
 	var content []byte
-	content, err = ioutil.ReadAll(file)
+	content, err = ioutil.ReadAll(r)
 	return content, errors.WithAftermath(err, file.Close())
 }
 
-func WriteFile(filename string, content []byte) error {
-	var file, err = CreateFileTmp(filename)
+func WriteFile(filename string, content []byte, opts ...Option) error {
+	var file, err = CreateFileTmp(filename, opts...)
 	if err != nil {
 		return err
 	}
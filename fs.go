@@ -0,0 +1,281 @@
+package fileutils
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/infobaleen/errors"
+)
+
+// FS is a filesystem used by the functions of this package, which can be selected with the WithFS option.
+// OSFS is the default and MemFS keeps everything in memory. Paths are always absolute after cleaning.
+// Implementations should return errors for which os.IsNotExist and os.IsExist work.
+// Filesystems that support atomic renames without replacing or with exchanging the destination can implement
+// RenameNoReplaceFS and RenameExchangeFS. Features that depend on the operating system, like memory mapping,
+// locking, O_TMPFILE and fast copying, are only used with OSFS.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (FSFile, error)
+	Mkdir(name string, perm os.FileMode) error
+	Rename(oldName, newName string) error
+	Remove(name string) error
+	Link(oldName, newName string) error
+	Symlink(target, name string) error
+	Readlink(name string) (string, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	// ReadDir returns the entries of a directory sorted by name, like ioutil.ReadDir.
+	ReadDir(name string) ([]os.FileInfo, error)
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	// SyncDir makes changes to the entries of a directory durable.
+	SyncDir(name string) error
+}
+
+// FSFile is an open file of an FS. It is implemented by *os.File.
+type FSFile interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+	Chmod(mode os.FileMode) error
+}
+
+// RenameNoReplaceFS is implemented by filesystems that can rename files without replacing the destination.
+type RenameNoReplaceFS interface {
+	FS
+	// RenameNoReplace renames a file and fails if the new name exists.
+	RenameNoReplace(oldName, newName string) error
+}
+
+// RenameExchangeFS is implemented by filesystems that can atomically exchange two files.
+type RenameExchangeFS interface {
+	FS
+	// RenameExchange atomically swaps the files at both paths.
+	RenameExchange(oldName, newName string) error
+}
+
+// WithFS makes functions use the filesystem fs instead of OSFS.
+func WithFS(fs FS) Option {
+	return func(o *options) {
+		o.fs = fs
+	}
+}
+
+// OSFS is the filesystem of the operating system.
+var OSFS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (FSFile, error) {
+	var f, err = os.OpenFile(name, flag, perm)
+	if err != nil {
+		// avoid returning a non-nil interface holding a nil pointer
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (osFS) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (osFS) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (osFS) RenameNoReplace(oldName, newName string) error {
+	return osRenameNoReplace(oldName, newName)
+}
+
+func (osFS) RenameExchange(oldName, newName string) error {
+	return osRenameExchange(oldName, newName)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (osFS) Link(oldName, newName string) error {
+	return os.Link(oldName, newName)
+}
+
+func (osFS) Symlink(target, name string) error {
+	return os.Symlink(target, name)
+}
+
+func (osFS) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFS) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+func (osFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (osFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (osFS) DiskUsage(name string) (Usage, error) {
+	return diskUsage(name)
+}
+
+func (osFS) SyncDir(name string) error {
+	var d, err = os.Open(name)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if err != nil {
+		return errors.WithAftermath(errors.Wrap(err, "syncing directory %q failed", name), d.Close())
+	}
+	return d.Close()
+}
+
+// absPath makes a path absolute. Paths of filesystems other than OSFS are relative to their root.
+func absPath(fs FS, path string) (string, error) {
+	if fs == OSFS {
+		return filepath.Abs(path)
+	}
+	return filepath.Join(string(filepath.Separator), path), nil
+}
+
+func mkdirAll(fs FS, path string, perm os.FileMode) error {
+	if fs, ok := fs.(interface {
+		MkdirAll(string, os.FileMode) error
+	}); ok {
+		return fs.MkdirAll(path, perm)
+	}
+	var info, err = fs.Stat(path)
+	if err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	var parent = filepath.Dir(path)
+	if parent != path {
+		err = mkdirAll(fs, parent, perm)
+		if err != nil {
+			return err
+		}
+	}
+	err = fs.Mkdir(path, perm)
+	if os.IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+func removeAll(fs FS, path string) error {
+	if fs, ok := fs.(interface{ RemoveAll(string) error }); ok {
+		return fs.RemoveAll(path)
+	}
+	var info, err = fs.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		var infos []os.FileInfo
+		infos, err = fs.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			err = removeAll(fs, filepath.Join(path, info.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = fs.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func renameNoReplace(fs FS, oldName, newName string) error {
+	if fs, ok := fs.(RenameNoReplaceFS); ok {
+		return fs.RenameNoReplace(oldName, newName)
+	}
+	return renameNoReplaceLink(fs, oldName, newName)
+}
+
+// renameNoReplaceLink emulates renameNoReplace with a hard link, which fails if newName exists.
+// Directories can't be hard linked, so they are renamed after checking that newName doesn't exist. That is racy:
+// an empty directory created at newName in between is replaced.
+func renameNoReplaceLink(fs FS, oldName, newName string) error {
+	var info, err = fs.Lstat(oldName)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		_, err = fs.Lstat(newName)
+		if err == nil {
+			return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrExist}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		return fs.Rename(oldName, newName)
+	}
+	err = fs.Link(oldName, newName)
+	if err != nil {
+		return err
+	}
+	return fs.Remove(oldName)
+}
+
+func renameExchange(fs FS, oldName, newName string) error {
+	if fs, ok := fs.(RenameExchangeFS); ok {
+		return fs.RenameExchange(oldName, newName)
+	}
+	return errors.Fmt("atomic exchange is not supported by the filesystem")
+}
+
+// sameFile is like os.SameFile, but also works for files of other filesystems.
+func sameFile(a, b os.FileInfo) bool {
+	if a, ok := a.(interface{ SameFile(os.FileInfo) bool }); ok {
+		return a.SameFile(b)
+	}
+	return os.SameFile(a, b)
+}
+
+// osFile returns the underlying *os.File or an error if the file is from another filesystem.
+func osFile(file FSFile) (*os.File, error) {
+	if file, ok := file.(*os.File); ok {
+		return file, nil
+	}
+	return nil, errors.Fmt("%q is not an operating system file", file.Name())
+}
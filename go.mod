@@ -6,4 +6,4 @@ require (
 	golang.org/x/sys v0.0.0-20190508100423-12bbe5a7a520
 )
 
-go 1.13
+go 1.16
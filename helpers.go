@@ -3,6 +3,7 @@ package fileutils
 import (
 	"fmt"
 	"github.com/infobaleen/errors"
+	"io/fs"
 	"path"
 	"reflect"
 )
@@ -12,7 +13,12 @@ const (
 	TagKeyJsonFile   = "json-file"
 )
 
-func PopulateTaggedStruct(dir string, p interface{}) error {
+func PopulateTaggedStruct(dir string, p interface{}, opts ...Option) error {
+	return PopulateTaggedStructFS(toIOFS(opts), dir, p, opts...)
+}
+
+// PopulateTaggedStructFS is like PopulateTaggedStruct, but reads the files from fsys.
+func PopulateTaggedStructFS(fsys fs.FS, dir string, p interface{}, opts ...Option) error {
 	var val = toValue(p)
 	if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
 		return errors.Fmt("expected pointer to struct")
@@ -21,11 +27,11 @@ func PopulateTaggedStruct(dir string, p interface{}) error {
 
 	for i := 0; i < val.NumField(); i++ {
 		if tag := val.Type().Field(i).Tag.Get(TagKeyBinaryFile); tag != "" {
-			if err := ReadBinaryFile(path.Join(dir, tag), getAddrInterface(val.Field(i))); err != nil {
+			if err := ReadBinaryFileFS(fsys, path.Join(dir, tag), getAddrInterface(val.Field(i)), opts...); err != nil {
 				return err
 			}
 		} else if tag := val.Type().Field(i).Tag.Get(TagKeyJsonFile); tag != "" {
-			if err := ReadJsonFile(path.Join(dir, tag), getAddrInterface(val.Field(i))); err != nil {
+			if err := ReadJsonFileFS(fsys, path.Join(dir, tag), getAddrInterface(val.Field(i)), opts...); err != nil {
 				return err
 			}
 		}
@@ -52,14 +58,14 @@ func IterateTaggedStruct(v interface{}, f func(fileType, fileName string, field
 	return nil
 }
 
-func WriteTaggedStructFiles(dir string, v interface{}) error {
+func WriteTaggedStructFiles(dir string, v interface{}, opts ...Option) error {
 	return IterateTaggedStruct(v, func(fileType, fileName string, field reflect.Value) error {
 		var path = path.Join(dir, fileName)
 		switch fileType {
 		case TagKeyBinaryFile:
-			return WriteBinaryFile(path, field)
+			return WriteBinaryFile(path, field, opts...)
 		case TagKeyJsonFile:
-			return WriteJsonFile(path, field)
+			return WriteJsonFileValues(path, []interface{}{field}, opts...)
 		default:
 			return fmt.Errorf("unknown file type %q", fileType)
 		}
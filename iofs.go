@@ -0,0 +1,50 @@
+package fileutils
+
+import (
+	"io/fs"
+	"os"
+)
+
+// ioFS adapts an FS to io/fs.FS, so the path based functions can share the implementation of their io/fs variants.
+// Unlike other implementations of io/fs.FS, it accepts any path of the FS, including absolute and relative paths.
+type ioFS struct {
+	fsys FS
+}
+
+func (f ioFS) Open(name string) (fs.File, error) {
+	return f.fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f ioFS) Stat(name string) (fs.FileInfo, error) {
+	return f.fsys.Stat(name)
+}
+
+func (f ioFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	var infos, err = f.fsys.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	var entries = make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = dirEntry{info}
+	}
+	return entries, nil
+}
+
+// dirEntry is an io/fs.DirEntry for a FileInfo that was already read.
+type dirEntry struct {
+	fs.FileInfo
+}
+
+func (e dirEntry) Type() fs.FileMode {
+	return e.Mode().Type()
+}
+
+func (e dirEntry) Info() (fs.FileInfo, error) {
+	return e.FileInfo, nil
+}
+
+// toIOFS returns the filesystem selected by the options as io/fs.FS.
+func toIOFS(opts []Option) fs.FS {
+	return ioFS{newOptions(opts).fs}
+}
@@ -4,38 +4,47 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"os"
+	"io/fs"
 	"reflect"
 
 	"github.com/infobaleen/errors"
 )
 
-func ReadJsonFile(filename string, p interface{}) error {
-	var file, err = os.Open(filename)
+func ReadJsonFile(filename string, p interface{}, opts ...Option) error {
+	return ReadJsonFileFS(toIOFS(opts), filename, p, opts...)
+}
+
+// ReadJsonFileFS is like ReadJsonFile, but reads from fsys.
+func ReadJsonFileFS(fsys fs.FS, name string, p interface{}, opts ...Option) error {
+	var file, r, _, err = openDecoded(fsys, name, opts)
 	if err != nil {
 		return err
 	}
-	err = json.NewDecoder(file).Decode(p)
+	err = json.NewDecoder(r).Decode(p)
 	if err != nil {
 		return errors.WithAftermath(err, file.Close())
 	}
 	return file.Close()
 }
 
-func ReadJsonFileAppend(filename string, p interface{}) error {
+func ReadJsonFileAppend(filename string, p interface{}, opts ...Option) error {
 	var value = recursiveIndirect(toValue(p))
 	if !value.CanAddr() || value.Kind() != reflect.Slice {
 		return fmt.Errorf("value is not an addressable slice")
 	}
 	value.Addr()
-	var file, err = os.Open(filename)
+	var file, r, _, err = openDecoded(toIOFS(opts), filename, opts)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	var dec = json.NewDecoder(file)
+	var m = newMonitor(newOptions(opts), filename, -1)
+	var dec = json.NewDecoder(monitoredReader{r, m})
 	var single = reflect.New(value.Type().Elem())
 	for {
+		if err = m.check(); err != nil {
+			return err
+		}
 		single.Elem().Set(reflect.Zero(value.Type().Elem()))
 		err = dec.Decode(single.Interface())
 		if err == io.EOF {
@@ -47,8 +56,16 @@ func ReadJsonFileAppend(filename string, p interface{}) error {
 	}
 }
 
+// WriteJsonFile writes the values to a temporary file that is finalized at filename.
+// It is the option-less shorthand of WriteJsonFileValues, which should be used to pass options.
 func WriteJsonFile(filename string, v ...interface{}) error {
-	var file, err = CreateFileTmp(filename)
+	return WriteJsonFileValues(filename, v)
+}
+
+// WriteJsonFileValues writes the values to a temporary file that is finalized at filename, applying the options to
+// the file.
+func WriteJsonFileValues(filename string, v []interface{}, opts ...Option) error {
+	var file, err = CreateFileTmp(filename, opts...)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,125 @@
+package fileutils
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// LeakAction decides what happens to a temporary file that is garbage collected without being closed.
+type LeakAction int
+
+const (
+	// LeakFinalize finalizes leaked temporary files like Close.
+	LeakFinalize LeakAction = iota
+	// LeakRemove removes leaked temporary files like RemoveIfTmp, because their contents may be incomplete.
+	LeakRemove
+)
+
+// DefaultLeakAction is used for files that are created afterwards, unless the OnLeak option is used.
+var DefaultLeakAction = LeakFinalize
+
+var leakMutex sync.Mutex
+var leakDebug bool
+var leakHandler = func(leak Leak) {
+	log.Println(leak)
+}
+
+// SetLeakDebug enables recording the stack trace where each File and MmapHandle is created, so it can be reported if
+// the object is leaked. It affects objects that are created afterwards and makes creating them slower.
+func SetLeakDebug(enabled bool) {
+	leakMutex.Lock()
+	defer leakMutex.Unlock()
+	leakDebug = enabled
+}
+
+// SetLeakHandler sets the function that is called for every File or MmapHandle that is garbage collected without
+// being closed, after it was closed. It is called from finalizers and must be safe to call concurrently.
+// The default logs the leak with the log package. The previous handler is returned.
+func SetLeakHandler(handler func(leak Leak)) func(leak Leak) {
+	leakMutex.Lock()
+	defer leakMutex.Unlock()
+	var previous = leakHandler
+	leakHandler = handler
+	return previous
+}
+
+// reportLeak passes a leak to the handler.
+func reportLeak(leak Leak) {
+	leakMutex.Lock()
+	var handler = leakHandler
+	leakMutex.Unlock()
+	handler(leak)
+}
+
+// Leak describes a File or MmapHandle that was garbage collected without being closed.
+type Leak struct {
+	// Type is "File" or "MmapHandle".
+	Type string
+	// Path is the path of the file. For temporary files it is the temporary path, unless the file is anonymous.
+	Path string
+	// Tmp is true for temporary files, which are handled according to Action.
+	Tmp    bool
+	Action LeakAction
+	// Stack is the stack trace where the object was created, if enabled with SetLeakDebug.
+	Stack string
+	// Err is the error returned while closing the object.
+	Err error
+}
+
+func (l Leak) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "GC found unclosed %s %q", l.Type, l.Path)
+	if l.Tmp && l.Action == LeakRemove {
+		b.WriteString(", removed it")
+	} else if l.Tmp {
+		b.WriteString(", finalized it")
+	} else {
+		b.WriteString(", closed it")
+	}
+	if l.Err != nil {
+		fmt.Fprintf(&b, " with error: %v", l.Err)
+	}
+	if l.Stack != "" {
+		fmt.Fprintf(&b, "\ncreated at:\n%s", l.Stack)
+	}
+	return b.String()
+}
+
+// OnLeak sets what happens to the temporary file if it is garbage collected without being closed.
+func OnLeak(action LeakAction) Option {
+	return func(o *options) {
+		o.leakAction = action
+	}
+}
+
+// leakStack records the stack of the caller's caller if leak debugging is enabled.
+func leakStack() []uintptr {
+	leakMutex.Lock()
+	var debug = leakDebug
+	leakMutex.Unlock()
+	if !debug {
+		return nil
+	}
+	var pcs = make([]uintptr, 32)
+	return pcs[:runtime.Callers(3, pcs)]
+}
+
+// formatStack formats a stack recorded by leakStack like a stack trace of a panic.
+func formatStack(pcs []uintptr) string {
+	if len(pcs) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	var frames = runtime.CallersFrames(pcs)
+	for {
+		var frame, more = frames.Next()
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,259 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd || solaris
+// +build linux darwin dragonfly freebsd netbsd openbsd solaris
+
+package fileutils
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/infobaleen/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ErrLocked is the cause of errors returned when a lock is held by someone else (see github.com/pkg/errors).
+const ErrLocked = constError("file is locked")
+
+const lockPollInterval = 10 * time.Millisecond
+
+// tmpLocks tells whether temporary files are locked while in use.
+const tmpLocks = true
+
+// Lock acquires an exclusive advisory lock on the file, waiting until it is available.
+// The lock is held by the open file and is released by Unlock or Close. It is not recursive.
+// Locks are taken with flock rather than fcntl OFD locks. Both are owned by the open file description, so closing another
+// descriptor of the same file doesn't release them, but OFD locks only exist on Linux, while flock is available on all
+// platforms that support locking here.
+func (f *File) Lock() error {
+	var _, err = f.flock(unix.LOCK_EX, true)
+	return err
+}
+
+// RLock acquires a shared advisory lock on the file, waiting until it is available.
+func (f *File) RLock() error {
+	var _, err = f.flock(unix.LOCK_SH, true)
+	return err
+}
+
+// TryLock acquires an exclusive advisory lock on the file if that is possible without waiting.
+func (f *File) TryLock() (bool, error) {
+	return f.flock(unix.LOCK_EX|unix.LOCK_NB, true)
+}
+
+// TryRLock acquires a shared advisory lock on the file if that is possible without waiting.
+func (f *File) TryRLock() (bool, error) {
+	return f.flock(unix.LOCK_SH|unix.LOCK_NB, true)
+}
+
+// Unlock releases a lock acquired by Lock, RLock, TryLock or TryRLock.
+// Named temporary files keep a shared lock, which protects them from CleanupTmpFiles.
+func (f *File) Unlock() error {
+	f.mutex.RLock()
+	var how = unix.LOCK_UN
+	if f.tmp && !f.anonymous {
+		how = unix.LOCK_SH
+	}
+	f.mutex.RUnlock()
+	var _, err = f.flock(how, false)
+	return err
+}
+
+// flock changes the lock of the file. locked tells whether the caller holds a lock afterwards.
+func (f *File) flock(how int, locked bool) (bool, error) {
+	f.mutex.Lock()
+	if err := f.ifClosedError(); err != nil {
+		f.mutex.Unlock()
+		return false, err
+	}
+	var file, err = osFile(f.file)
+	f.mutex.Unlock()
+	if err != nil {
+		return false, err
+	}
+	var fd = int(file.Fd())
+	// the mutex is not held while waiting, so that other methods can be used concurrently
+	var ok bool
+	ok, err = flock(fd, how)
+	if ok {
+		f.mutex.Lock()
+		f.locked = locked
+		f.mutex.Unlock()
+	}
+	return ok, err
+}
+
+func flock(fd int, how int) (bool, error) {
+	for {
+		var err = unix.Flock(fd, how)
+		if err == unix.EINTR {
+			continue
+		} else if err == unix.EWOULDBLOCK {
+			return false, nil
+		} else if err != nil {
+			return false, errors.Wrap(err, "flock failed")
+		}
+		return true, nil
+	}
+}
+
+// lockTmp marks a temporary file as in use by holding a shared lock on it.
+func lockTmp(file FSFile) error {
+	var osFile, isOS = file.(*os.File)
+	if !isOS {
+		// other filesystems are not shared with other processes
+		return nil
+	}
+	var ok, err = flock(int(osFile.Fd()), unix.LOCK_SH|unix.LOCK_NB)
+	if err == nil && !ok {
+		err = errors.Wrap(ErrLocked, "temporary file %q is in use", file.Name())
+	}
+	return err
+}
+
+// unlockTmp releases the shared lock of a named temporary file once it is finalized, unless the lock was replaced by
+// one of the caller.
+func (f *File) unlockTmp() error {
+	var file, isOS = f.file.(*os.File)
+	if !isOS || f.anonymous || f.locked {
+		return nil
+	}
+	var _, err = flock(int(file.Fd()), unix.LOCK_UN)
+	return err
+}
+
+// lockTmpUnused acquires an exclusive lock on a temporary file, if it is not in use.
+func lockTmpUnused(file *os.File) (bool, error) {
+	return flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+}
+
+// FileLock is a lock held on a lock file by LockFile.
+type FileLock struct {
+	path      string
+	file      *os.File
+	exclusive bool
+}
+
+// LockFile acquires an exclusive lock on the lock file at path, which is created if necessary.
+// It gives up after the timeout with an error caused by ErrLocked. A timeout of 0 means that the lock is only tried once,
+// while a negative timeout waits indefinitely.
+// The lock is held using flock, so it is released automatically when the process dies. On filesystems that don't
+// support flock, the lock file is created exclusively instead and removed by Unlock. Such lock files are considered stale
+// and replaced if the process whose id is written to them no longer exists.
+func LockFile(path string, timeout time.Duration) (*FileLock, error) {
+	var deadline = time.Now().Add(timeout)
+	var l = &FileLock{path: path}
+	for {
+		var ok, err = l.try(timeout < 0)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			return l, nil
+		}
+		if timeout >= 0 && !time.Now().Before(deadline) {
+			return nil, errors.Wrap(ErrLocked, "%q is held by process %s", path, readLockOwner(path))
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+func (l *FileLock) try(wait bool) (bool, error) {
+	var file, err = os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return false, err
+	}
+	var how = unix.LOCK_EX
+	if !wait {
+		how |= unix.LOCK_NB
+	}
+	var ok bool
+	ok, err = flock(int(file.Fd()), how)
+	if cause := errors.Cause(err); cause == unix.ENOLCK || cause == unix.EOPNOTSUPP || cause == unix.ENOSYS {
+		_ = file.Close()
+		return l.tryExclusive()
+	} else if err != nil || !ok {
+		return false, errors.WithAftermath(err, file.Close())
+	}
+
+	// the lock file may have been replaced between opening and locking it
+	var lockedInfo, currentInfo os.FileInfo
+	lockedInfo, err = file.Stat()
+	if err == nil {
+		currentInfo, err = os.Stat(l.path)
+	}
+	if os.IsNotExist(err) || (err == nil && !os.SameFile(lockedInfo, currentInfo)) {
+		return false, file.Close()
+	} else if err != nil {
+		return false, errors.WithAftermath(err, file.Close())
+	}
+
+	l.file = file
+	err = writeLockOwner(file)
+	if err != nil {
+		return false, errors.WithAftermath(err, l.Unlock())
+	}
+	return true, nil
+}
+
+func (l *FileLock) tryExclusive() (bool, error) {
+	var file, err = os.OpenFile(l.path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		var pid int
+		pid, err = strconv.Atoi(readLockOwner(l.path))
+		if err == nil && unix.Kill(pid, 0) == unix.ESRCH {
+			// the owner died without unlocking. Removing the stale file is racy if several processes detect it at
+			// the same time, but flock is not available to do better.
+			err = os.Remove(l.path)
+			if err != nil && !os.IsNotExist(err) {
+				return false, err
+			}
+		}
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	l.file = file
+	l.exclusive = true
+	err = writeLockOwner(file)
+	if err != nil {
+		return false, errors.WithAftermath(err, l.Unlock())
+	}
+	return true, nil
+}
+
+func writeLockOwner(file *os.File) error {
+	var err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	return err
+}
+
+func readLockOwner(path string) string {
+	var content, err = ioutil.ReadFile(path)
+	if err != nil || len(content) == 0 {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// Path returns the path of the lock file.
+func (l *FileLock) Path() string {
+	return l.path
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	if l.file == nil {
+		return errors.Fmt("lock %q is not held", l.path)
+	}
+	var err error
+	if l.exclusive {
+		err = os.Remove(l.path)
+	}
+	err = appendError(err, l.file.Close())
+	l.file = nil
+	return err
+}
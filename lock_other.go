@@ -0,0 +1,23 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd || solaris)
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd,!solaris
+
+package fileutils
+
+import "os"
+
+// tmpLocks tells whether temporary files are locked while in use.
+const tmpLocks = false
+
+func lockTmp(file FSFile) error {
+	return nil
+}
+
+func (f *File) unlockTmp() error {
+	return nil
+}
+
+// lockTmpUnused always reports temporary files as in use, because they are not locked on this platform and removing
+// them could break live writers.
+func lockTmpUnused(file *os.File) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,69 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd || solaris
+// +build linux darwin dragonfly freebsd netbsd openbsd solaris
+
+package fileutils
+
+import (
+	"github.com/infobaleen/errors"
+	"github.com/matryer/is"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLockFile(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var lockPath = path.Join(tmpDir, "lock")
+
+	var l *FileLock
+	l, err = LockFile(lockPath, 0)
+	is.NoErr(err)
+	_, err = LockFile(lockPath, 20*time.Millisecond)
+	is.Equal(errors.Cause(err), ErrLocked)
+	is.NoErr(l.Unlock())
+	l, err = LockFile(lockPath, 0)
+	is.NoErr(err)
+	is.NoErr(l.Unlock())
+	l, err = LockFile(path.Join(tmpDir, "missing", "lock"), 0)
+	is.True(os.IsNotExist(errors.Cause(err)))
+	is.True(l == nil)
+
+	var f1, f2 *File
+	f1, err = OpenFile(lockPath)
+	is.NoErr(err)
+	defer f1.Close()
+	f2, err = OpenFile(lockPath)
+	is.NoErr(err)
+	defer f2.Close()
+	is.NoErr(f1.RLock())
+	var ok bool
+	ok, err = f2.TryRLock()
+	is.NoErr(err)
+	is.True(ok)
+	ok, err = f1.TryLock()
+	is.NoErr(err)
+	is.True(!ok)
+	is.NoErr(f2.Unlock())
+	ok, err = f1.TryLock()
+	is.NoErr(err)
+	is.True(ok)
+
+	// finalized temporary files don't keep the shared lock that protects them from CleanupTmpFiles
+	var target = path.Join(tmpDir, "target")
+	var tmp, other *File
+	tmp, err = CreateFileTmp(target, NamedTmp())
+	is.NoErr(err)
+	defer tmp.Close()
+	is.NoErr(tmp.Finalize())
+	other, err = OpenFile(target)
+	is.NoErr(err)
+	defer other.Close()
+	ok, err = other.TryLock()
+	is.NoErr(err)
+	is.True(ok)
+}
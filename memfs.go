@@ -0,0 +1,717 @@
+package fileutils
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxSymlinks is the number of symbolic links that are followed while resolving a path, before giving up.
+const maxSymlinks = 40
+
+// MemFS is a filesystem that is kept in memory, which is useful for tests. It supports directories, hard links and
+// symbolic links, atomic renames with and without replacing the destination, and atomic exchanges.
+// Permissions are stored but not enforced. All methods are safe to call concurrently.
+//
+// Like a disk, MemFS distinguishes between the visible state and the durable state, which only contains the contents
+// of files that were synced and the entries of directories that were synced. Crash simulates a power loss by reverting
+// to the durable state.
+type MemFS struct {
+	mutex   sync.Mutex
+	root    *memNode
+	crashes int
+}
+
+// memNode is an inode of a MemFS.
+type memNode struct {
+	mode          os.FileMode
+	modTime       time.Time
+	data          []byte              // contents of regular files
+	syncedData    []byte              // durable contents of regular files
+	entries       map[string]*memNode // entries of directories
+	syncedEntries map[string]*memNode // durable entries of directories
+	target        string              // target of symbolic links
+}
+
+// NewMemFS returns an empty MemFS, which only contains the root directory.
+func NewMemFS() *MemFS {
+	return &MemFS{root: newMemNode(os.ModeDir | 0777)}
+}
+
+func newMemNode(mode os.FileMode) *memNode {
+	var n = &memNode{mode: mode, modTime: time.Now()}
+	if mode.IsDir() {
+		n.entries = make(map[string]*memNode)
+		n.syncedEntries = make(map[string]*memNode)
+	}
+	return n
+}
+
+// sync makes the current contents or entries of the node durable.
+func (n *memNode) sync() {
+	if n.mode.IsDir() {
+		n.syncedEntries = copyEntries(n.entries)
+	} else {
+		n.syncedData = append([]byte(nil), n.data...)
+	}
+}
+
+func copyEntries(entries map[string]*memNode) map[string]*memNode {
+	var c = make(map[string]*memNode, len(entries))
+	for name, node := range entries {
+		c[name] = node
+	}
+	return c
+}
+
+// Crash simulates a power loss, after which only the durable state remains: unsynced data is dropped and unsynced
+// changes of directory entries like creations, renames and removals are reverted.
+// Files that were opened before can't be used anymore.
+func (fs *MemFS) Crash() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.crashes++
+	var visited = make(map[*memNode]bool)
+	var revert func(n *memNode)
+	revert = func(n *memNode) {
+		if visited[n] {
+			return
+		}
+		visited[n] = true
+		if n.mode.IsDir() {
+			n.entries = copyEntries(n.syncedEntries)
+			for _, entry := range n.entries {
+				revert(entry)
+			}
+		} else {
+			n.data = append([]byte(nil), n.syncedData...)
+		}
+	}
+	revert(fs.root)
+}
+
+// SyncAll makes the whole filesystem durable, like sync(2).
+func (fs *MemFS) SyncAll() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var visited = make(map[*memNode]bool)
+	var sync func(n *memNode)
+	sync = func(n *memNode) {
+		if visited[n] {
+			return
+		}
+		visited[n] = true
+		n.sync()
+		for _, entry := range n.entries {
+			sync(entry)
+		}
+	}
+	sync(fs.root)
+}
+
+func (n *memNode) isSymlink() bool {
+	return n.mode&os.ModeSymlink != 0
+}
+
+// touch updates the modification time of the node.
+func (n *memNode) touch() {
+	n.modTime = time.Now()
+}
+
+// resolve looks up a path and returns the directory that contains it, the base name and the node, which is nil if
+// the directory has no entry with the base name. If follow is true and the path is a symbolic link, the link is
+// followed and the returned values refer to its target. The caller must hold the mutex.
+func (fs *MemFS) resolve(name string, follow bool) (*memNode, string, *memNode, error) {
+	var links int
+	return fs.resolveLinks(name, follow, &links)
+}
+
+func (fs *MemFS) resolveLinks(name string, follow bool, links *int) (*memNode, string, *memNode, error) {
+	name = filepath.Join(string(filepath.Separator), name)
+	if name == string(filepath.Separator) {
+		return fs.root, ".", fs.root, nil
+	}
+	var dirName, base = filepath.Split(name)
+	var dir, err = fs.lookupDir(dirName, links)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	var node = dir.entries[base]
+	if follow && node != nil && node.isSymlink() {
+		*links++
+		if *links > maxSymlinks {
+			return nil, "", nil, syscall.ELOOP
+		}
+		var target = node.target
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(dirName, target)
+		}
+		return fs.resolveLinks(target, true, links)
+	}
+	return dir, base, node, nil
+}
+
+// lookupDir returns the directory at the path, following all symbolic links.
+func (fs *MemFS) lookupDir(name string, links *int) (*memNode, error) {
+	var node = fs.root
+	var parent = string(filepath.Separator)
+	for _, part := range strings.Split(name, string(filepath.Separator)) {
+		if part == "" {
+			continue
+		}
+		var next = node.entries[part]
+		if next == nil {
+			return nil, syscall.ENOENT
+		}
+		if next.isSymlink() {
+			var _, _, target, err = fs.resolveLinks(filepath.Join(parent, part), true, links)
+			if err != nil {
+				return nil, err
+			} else if target == nil {
+				return nil, syscall.ENOENT
+			}
+			next = target
+		}
+		if !next.mode.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+		node = next
+		parent = filepath.Join(parent, part)
+	}
+	return node, nil
+}
+
+// lookup returns the existing node at the path.
+func (fs *MemFS) lookup(op, name string, follow bool) (*memNode, error) {
+	var _, _, node, err = fs.resolve(name, follow)
+	if err == nil && node == nil {
+		err = syscall.ENOENT
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return node, nil
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (FSFile, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var dir, base, node, err = fs.resolve(name, true)
+	if err == nil {
+		if node == nil && flag&os.O_CREATE != 0 {
+			node = newMemNode(perm.Perm())
+			dir.entries[base] = node
+			dir.touch()
+		} else if node == nil {
+			err = syscall.ENOENT
+		} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			err = syscall.EEXIST
+		} else if node.mode.IsDir() && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			err = syscall.EISDIR
+		}
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	if flag&os.O_TRUNC != 0 && node.mode.IsRegular() {
+		node.data = nil
+		node.touch()
+	}
+	return &memFile{fs: fs, node: node, name: name, flag: flag, crashes: fs.crashes}, nil
+}
+
+func (fs *MemFS) Mkdir(name string, perm os.FileMode) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var dir, base, node, err = fs.resolve(name, false)
+	if err == nil && node != nil {
+		err = syscall.EEXIST
+	}
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	dir.entries[base] = newMemNode(os.ModeDir | perm.Perm())
+	dir.touch()
+	return nil
+}
+
+// MkdirAll creates a directory and all missing parents.
+func (fs *MemFS) MkdirAll(name string, perm os.FileMode) error {
+	var info, err = fs.Stat(name)
+	if err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	var parent = filepath.Dir(filepath.Join(string(filepath.Separator), name))
+	if parent != string(filepath.Separator) {
+		err = fs.MkdirAll(parent, perm)
+		if err != nil {
+			return err
+		}
+	}
+	err = fs.Mkdir(name, perm)
+	if os.IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (fs *MemFS) Rename(oldName, newName string) error {
+	return fs.rename(oldName, newName, false)
+}
+
+// RenameNoReplace renames a file and fails if the new name exists.
+func (fs *MemFS) RenameNoReplace(oldName, newName string) error {
+	return fs.rename(oldName, newName, true)
+}
+
+func (fs *MemFS) rename(oldName, newName string, noReplace bool) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var oldDir, oldBase, node, newDir, newBase, existing, err = fs.resolvePair(oldName, newName)
+	if err == nil {
+		if node == existing {
+			return nil
+		} else if existing != nil && noReplace {
+			err = syscall.EEXIST
+		} else if existing != nil && node.mode.IsDir() && !existing.mode.IsDir() {
+			err = syscall.ENOTDIR
+		} else if existing != nil && !node.mode.IsDir() && existing.mode.IsDir() {
+			err = syscall.EISDIR
+		} else if existing != nil && len(existing.entries) > 0 {
+			err = syscall.ENOTEMPTY
+		} else if node.mode.IsDir() && isSubPath(oldName, newName) {
+			err = syscall.EINVAL
+		}
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: err}
+	}
+	delete(oldDir.entries, oldBase)
+	newDir.entries[newBase] = node
+	oldDir.touch()
+	newDir.touch()
+	return nil
+}
+
+// RenameExchange atomically swaps the files at both paths.
+func (fs *MemFS) RenameExchange(oldName, newName string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var oldDir, oldBase, node, newDir, newBase, existing, err = fs.resolvePair(oldName, newName)
+	if err == nil && existing == nil {
+		err = syscall.ENOENT
+	} else if err == nil && (isSubPath(oldName, newName) || isSubPath(newName, oldName)) {
+		err = syscall.EINVAL
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: err}
+	}
+	oldDir.entries[oldBase], newDir.entries[newBase] = existing, node
+	oldDir.touch()
+	newDir.touch()
+	return nil
+}
+
+// resolvePair resolves the paths of a rename or link, without following symbolic links at the end of the paths.
+// The old path must exist. The caller must hold the mutex.
+func (fs *MemFS) resolvePair(oldName, newName string) (*memNode, string, *memNode, *memNode, string, *memNode, error) {
+	var oldDir, oldBase, node, err = fs.resolve(oldName, false)
+	if err == nil && node == nil {
+		err = syscall.ENOENT
+	}
+	if err != nil {
+		return nil, "", nil, nil, "", nil, err
+	}
+	var newDir, existing *memNode
+	var newBase string
+	newDir, newBase, existing, err = fs.resolve(newName, false)
+	return oldDir, oldBase, node, newDir, newBase, existing, err
+}
+
+// isSubPath reports whether path is inside the directory dir.
+func isSubPath(dir, path string) bool {
+	dir = filepath.Join(string(filepath.Separator), dir)
+	path = filepath.Join(string(filepath.Separator), path)
+	return strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+func (fs *MemFS) Remove(name string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var dir, base, node, err = fs.resolve(name, false)
+	if err == nil && node == nil {
+		err = syscall.ENOENT
+	} else if err == nil && node == fs.root {
+		err = syscall.EBUSY
+	} else if err == nil && len(node.entries) > 0 {
+		err = syscall.ENOTEMPTY
+	}
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	delete(dir.entries, base)
+	dir.touch()
+	return nil
+}
+
+// RemoveAll removes a path and everything it contains. It returns nil if the path doesn't exist.
+func (fs *MemFS) RemoveAll(name string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var dir, base, node, err = fs.resolve(name, false)
+	if err == syscall.ENOENT || err == nil && node == nil {
+		return nil
+	} else if err == nil && node == fs.root {
+		err = syscall.EBUSY
+	}
+	if err != nil {
+		return &os.PathError{Op: "removeall", Path: name, Err: err}
+	}
+	delete(dir.entries, base)
+	dir.touch()
+	return nil
+}
+
+func (fs *MemFS) Link(oldName, newName string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var _, _, node, newDir, newBase, existing, err = fs.resolvePair(oldName, newName)
+	if err == nil && existing != nil {
+		err = syscall.EEXIST
+	} else if err == nil && node.mode.IsDir() {
+		err = syscall.EPERM
+	}
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldName, New: newName, Err: err}
+	}
+	newDir.entries[newBase] = node
+	newDir.touch()
+	return nil
+}
+
+func (fs *MemFS) Symlink(target, name string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var dir, base, node, err = fs.resolve(name, false)
+	if err == nil && node != nil {
+		err = syscall.EEXIST
+	}
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: name, Err: err}
+	}
+	node = newMemNode(os.ModeSymlink | 0777)
+	node.target = target
+	dir.entries[base] = node
+	dir.touch()
+	return nil
+}
+
+func (fs *MemFS) Readlink(name string) (string, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var node, err = fs.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	} else if !node.isSymlink() {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return node.target, nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var node, err = fs.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(filepath.Base(name)), nil
+}
+
+func (fs *MemFS) Lstat(name string) (os.FileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var node, err = fs.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(filepath.Base(name)), nil
+}
+
+func (fs *MemFS) ReadDir(name string) ([]os.FileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var node, err = fs.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	} else if !node.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdirent", Path: name, Err: syscall.ENOTDIR}
+	}
+	var infos = make([]os.FileInfo, 0, len(node.entries))
+	for name, entry := range node.entries {
+		infos = append(infos, entry.info(name))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (fs *MemFS) Chmod(name string, mode os.FileMode) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var node, err = fs.lookup("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	node.mode = node.mode&^os.ModePerm | mode.Perm()
+	return nil
+}
+
+func (fs *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var node, err = fs.lookup("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+	node.modTime = mtime
+	return nil
+}
+
+func (fs *MemFS) SyncDir(name string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var node, err = fs.lookup("sync", name, true)
+	if err != nil {
+		return err
+	} else if !node.mode.IsDir() {
+		return &os.PathError{Op: "sync", Path: name, Err: syscall.ENOTDIR}
+	}
+	node.sync()
+	return nil
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	return &memFileInfo{name: name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime, node: n}
+}
+
+// memFileInfo describes a node of a MemFS at the time it was returned.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	node    *memNode
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() interface{}   { return nil }
+
+// SameFile reports whether both infos describe the same file, like os.SameFile.
+func (i *memFileInfo) SameFile(other os.FileInfo) bool {
+	var o, ok = other.(*memFileInfo)
+	return ok && i.node == o.node
+}
+
+// memFile is an open file of a MemFS.
+type memFile struct {
+	fs      *MemFS
+	node    *memNode
+	name    string
+	flag    int
+	offset  int64
+	closed  bool
+	crashes int // the number of crashes of the filesystem when the file was opened
+}
+
+// checkOpen returns an error if the file was closed or the filesystem crashed since it was opened.
+// The caller must hold the mutex of the filesystem.
+func (f *memFile) checkOpen(op string) error {
+	if f.closed || f.crashes != f.fs.crashes {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+// check returns an error if the file is closed or the operation is not allowed by the flags it was opened with.
+// The caller must hold the mutex of the filesystem.
+func (f *memFile) check(op string, write bool) error {
+	if err := f.checkOpen(op); err != nil {
+		return err
+	}
+	var err error
+	if write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0 || !write && f.flag&os.O_WRONLY != 0 {
+		err = syscall.EBADF
+	} else if f.node.mode.IsDir() {
+		err = syscall.EISDIR
+	}
+	if err != nil {
+		return &os.PathError{Op: op, Path: f.name, Err: err}
+	}
+	return nil
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	var n, err = f.readAt("read", b, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	return f.readAt("read", b, off)
+}
+
+func (f *memFile) readAt(op string, b []byte, off int64) (int, error) {
+	if err := f.check(op, false); err != nil {
+		return 0, err
+	} else if off < 0 {
+		return 0, &os.PathError{Op: op, Path: f.name, Err: syscall.EINVAL}
+	} else if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	var n = copy(b, f.node.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+	var n, err = f.writeAt("write", b, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: syscall.EINVAL}
+	}
+	return f.writeAt("write", b, off)
+}
+
+func (f *memFile) writeAt(op string, b []byte, off int64) (int, error) {
+	if err := f.check(op, true); err != nil {
+		return 0, err
+	} else if off < 0 {
+		return 0, &os.PathError{Op: op, Path: f.name, Err: syscall.EINVAL}
+	}
+	var end = off + int64(len(b))
+	if end > int64(len(f.node.data)) {
+		f.node.resize(end)
+	}
+	copy(f.node.data[off:], b)
+	f.node.touch()
+	return len(b), nil
+}
+
+// resize changes the size of the file, filling new space with zeros.
+func (n *memNode) resize(size int64) {
+	if size <= int64(cap(n.data)) {
+		var old = len(n.data)
+		n.data = n.data[:size]
+		for i := old; i < len(n.data); i++ {
+			n.data[i] = 0
+		}
+		return
+	}
+	var data = make([]byte, size, size+size/4)
+	copy(data, n.data)
+	n.data = data
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if err := f.checkOpen("seek"); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if err := f.checkOpen("close"); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if err := f.checkOpen("stat"); err != nil {
+		return nil, err
+	}
+	return f.node.info(filepath.Base(f.name)), nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if err := f.checkOpen("sync"); err != nil {
+		return err
+	}
+	f.node.sync()
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	} else if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.node.resize(size)
+	f.node.touch()
+	return nil
+}
+
+func (f *memFile) Chmod(mode os.FileMode) error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if err := f.checkOpen("chmod"); err != nil {
+		return err
+	}
+	f.node.mode = f.node.mode&^os.ModePerm | mode.Perm()
+	return nil
+}
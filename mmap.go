@@ -5,10 +5,11 @@ package fileutils
 import (
 	"github.com/infobaleen/errors"
 	"golang.org/x/sys/unix"
-	"log"
+	"io"
 	"os"
 	"reflect"
 	"runtime"
+	"time"
 	"unsafe"
 )
 
@@ -17,51 +18,88 @@ import (
 func (f *File) Mmap(slicePointers ...interface{}) error {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
+	if err := f.ifClosedError(); err != nil {
+		return err
+	}
+	if err := f.ifEncodedError(); err != nil {
+		return err
+	}
+	f.invalidateChecksum()
 	if err := f.emptyBuffers(); err != nil {
 		return err
 	}
-	var unmap, err = MmapFd(f.file, slicePointers...)
+	var file, err = osFile(f.file)
+	if err != nil {
+		return err
+	}
+	var unmap *MmapHandle
+	unmap, err = mmapFd(file, f.observer, slicePointers)
+	if err != nil {
+		return err
+	}
 	f.onClose = append(f.onClose, unmap.Close)
-	return err
+	return nil
 }
 
 type MmapHandle struct {
 	bytes []byte
 	size  int
+	path     string
+	stack    []uintptr // where the mapping was created, if enabled with SetLeakDebug
+	observer Observer
 }
 
 func (h *MmapHandle) Close() error {
 	var bytes []byte
 	bytes, h.bytes = h.bytes, nil
-	return unix.Munmap(bytes)
+	var start = time.Now()
+	var err = unix.Munmap(bytes)
+	observe(h.observer, Event{Kind: EventMunmap, Path: h.path, Bytes: int64(len(bytes)), Err: err}, start)
+	return err
 }
 
 func (h *MmapHandle) setFinalizer() {
 	if h.bytes != nil {
+		h.stack = leakStack()
 		runtime.SetFinalizer(h, func(h *MmapHandle) {
 			if h.bytes != nil {
-				log.Println("GC found unclosed MmapHandle, closing...")
-				var err = h.Close()
-				if err != nil {
-					log.Println("Error closing MmapHandle:", err)
-				}
+				var leak = Leak{Type: "MmapHandle", Path: h.path, Stack: formatStack(h.stack)}
+				leak.Err = h.Close()
+				reportLeak(leak)
 			}
 		})
 	}
 }
 
+// MmapCreate creates a file of the specified size using a temporary file and maps it into memory.
+// It is the option-less shorthand of MmapCreateSlices.
 func MmapCreate(path string, size int64, slicePointers ...interface{}) (*MmapHandle, error) {
-	var f, err = CreateFileTmp(path)
+	return MmapCreateSlices(path, size, slicePointers)
+}
+
+// MmapCreateSlices creates a file of the specified size using a temporary file and maps it into memory, applying the
+// options to the file. Only OSFS is supported and checksums can't be written, because the contents are written after
+// the file is finalized.
+func MmapCreateSlices(path string, size int64, slicePointers []interface{}, opts ...Option) (*MmapHandle, error) {
+	var o = newOptions(opts)
+	if err := mmapSupported(o); err != nil {
+		return nil, err
+	} else if o.checksum != ChecksumNone {
+		return nil, errors.Fmt("checksums are not supported by MmapCreateSlices")
+	}
+	var f, err = CreateFileTmp(path, append([]Option{ExpectedSize(size)}, opts...)...)
 	if err != nil {
 		return nil, err
 	}
+	defer f.RemoveIfTmp()
 	if err = f.SetSize(size); err != nil {
 		return nil, err
 	}
 	var h *MmapHandle
-	if h, err = MmapFd(f.file, slicePointers...); err != nil {
+	if h, err = mmapFd(f.file.(*os.File), f.observer, slicePointers); err != nil {
 		return nil, err
 	}
+	h.path = f.target
 	err = f.Close()
 	if err != nil {
 		_ = h.Close()
@@ -71,16 +109,37 @@ func MmapCreate(path string, size int64, slicePointers ...interface{}) (*MmapHan
 	return h, nil
 }
 
+// Mmap maps an existing file into memory. It is the option-less shorthand of MmapSlices.
 func Mmap(path string, slicePointers ...interface{}) (*MmapHandle, error) {
+	return MmapSlices(path, slicePointers)
+}
+
+// MmapSlices maps an existing file into memory, applying the options. Only OSFS is supported.
+// With the WithChecksum option, the file is verified first and a trailer is excluded from the slices.
+func MmapSlices(path string, slicePointers []interface{}, opts ...Option) (*MmapHandle, error) {
+	var o = newOptions(opts)
+	if err := mmapSupported(o); err != nil {
+		return nil, err
+	}
 	var f, err = os.OpenFile(path, os.O_RDWR, 0666)
 	if err != nil {
 		return nil, err
 	}
+	var contents *io.SectionReader
+	if o.checksum != ChecksumNone {
+		contents, err = verifyChecksum(toIOFS(opts), path, f, o)
+		if err != nil {
+			return nil, errors.WithAftermath(err, f.Close())
+		}
+	}
 	var h *MmapHandle
-	h, err = MmapFd(f, slicePointers...)
+	h, err = mmapFd(f, o.observer, slicePointers)
 	if err != nil {
 		return nil, err
 	}
+	if contents != nil {
+		h.size = int(contents.Size())
+	}
 	err = f.Close()
 	if err != nil {
 		_ = h.Close()
@@ -110,7 +169,25 @@ func (h *MmapHandle) SetSlicePointer(slicePointers ...interface{}) {
 	}
 }
 
+// MmapFd maps an open file into memory. It is the option-less shorthand of MmapFdSlices.
 func MmapFd(f *os.File, slicePointers ...interface{}) (*MmapHandle, error) {
+	return MmapFdSlices(f, slicePointers)
+}
+
+// MmapFdSlices maps an open file into memory, applying the options.
+func MmapFdSlices(f *os.File, slicePointers []interface{}, opts ...Option) (*MmapHandle, error) {
+	return mmapFd(f, newOptions(opts).observer, slicePointers)
+}
+
+// mmapSupported fails if the options select a filesystem that can't be mapped into memory.
+func mmapSupported(o options) error {
+	if o.fs != OSFS {
+		return errors.Fmt("mmap is only supported by OSFS")
+	}
+	return nil
+}
+
+func mmapFd(f *os.File, obs Observer, slicePointers []interface{}) (*MmapHandle, error) {
 	if err := f.Sync(); err != nil {
 		return nil, err
 	}
@@ -118,10 +195,12 @@ func MmapFd(f *os.File, slicePointers ...interface{}) (*MmapHandle, error) {
 	if err != nil {
 		return nil, err
 	}
-	var h = new(MmapHandle)
+	var h = &MmapHandle{path: f.Name(), observer: obs}
 	h.size = int(info.Size())
 	if h.size > 0 {
+		var start = time.Now()
 		h.bytes, err = unix.Mmap(int(f.Fd()), 0, h.size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		observe(obs, Event{Kind: EventMmap, Path: h.path, Bytes: int64(h.size), Err: err}, start)
 		if err != nil {
 			return nil, errors.Wrap(err, "mmap failed")
 		}
@@ -0,0 +1,71 @@
+//go:build !windows
+// +build !windows
+
+package fileutils
+
+import (
+	"fmt"
+	"github.com/infobaleen/errors"
+	"github.com/matryer/is"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMmapOptions(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var values = []int64{1, 2, 3, 4}
+
+	for _, placement := range []ChecksumPlacement{ChecksumTrailer, ChecksumSidecar} {
+		for _, algorithm := range []ChecksumAlgorithm{ChecksumCRC32C, ChecksumSHA256} {
+			var opt = WithChecksum(algorithm, placement)
+			var binPath = path.Join(tmpDir, fmt.Sprintf("values%d%d", placement, algorithm))
+			is.NoErr(WriteBinaryFile(binPath, values, opt))
+			var check []int64
+			var h *MmapHandle
+			h, err = MmapSlices(binPath, []interface{}{&check}, opt)
+			is.NoErr(err)
+			is.Equal(check, values)
+			is.NoErr(h.Close())
+
+			var raw []byte
+			raw, err = ioutil.ReadFile(binPath)
+			is.NoErr(err)
+			raw[3] ^= 1
+			is.NoErr(ioutil.WriteFile(binPath, raw, 0666))
+			_, err = MmapSlices(binPath, []interface{}{&check}, opt)
+			var _, ok = errors.Cause(err).(*CorruptionError)
+			is.True(ok)
+		}
+	}
+
+	var usage Usage
+	usage, err = DiskUsage(tmpDir)
+	is.NoErr(err)
+	var createPath = path.Join(tmpDir, "created")
+	var check []int64
+	_, err = MmapCreateSlices(createPath, 1<<20, []interface{}{&check}, CheckFreeSpace(int64(usage.Total)))
+	is.Equal(errors.Cause(err), ErrInsufficientSpace)
+	_, err = MmapCreateSlices(createPath, 1<<20, []interface{}{&check}, WithFS(NewMemFS()))
+	is.True(err != nil)
+	_, err = MmapSlices(createPath, []interface{}{&check}, WithFS(NewMemFS()))
+	is.True(err != nil)
+	_, err = MmapCreateSlices(createPath, 1<<20, []interface{}{&check}, WithChecksum(ChecksumSHA256, ChecksumTrailer))
+	is.True(err != nil)
+	_, err = os.Stat(createPath)
+	is.True(os.IsNotExist(err))
+
+	var h *MmapHandle
+	h, err = MmapCreateSlices(createPath, 32, []interface{}{&check}, Perm(0600))
+	is.NoErr(err)
+	is.Equal(len(check), 4)
+	is.NoErr(h.Close())
+	var info os.FileInfo
+	info, err = os.Stat(createPath)
+	is.NoErr(err)
+	is.Equal(info.Mode().Perm(), os.FileMode(0600))
+}
@@ -1,7 +1,7 @@
 package fileutils
 
 import (
-	"io/ioutil"
+	"io/fs"
 	"math"
 	"os"
 	"sort"
@@ -22,8 +22,13 @@ func IsNumberedName(name string, prefix, suffix string) (uint64, bool) {
 	return 0, false
 }
 
-func FindNumberedFiles(dir, prefix, suffix string) ([]uint64, []string, error) {
-	var contents, err = ioutil.ReadDir(dir)
+func FindNumberedFiles(dir, prefix, suffix string, opts ...Option) ([]uint64, []string, error) {
+	return FindNumberedFilesFS(toIOFS(opts), dir, prefix, suffix)
+}
+
+// FindNumberedFilesFS is like FindNumberedFiles, but searches dir in fsys.
+func FindNumberedFilesFS(fsys fs.FS, dir, prefix, suffix string) ([]uint64, []string, error) {
+	var contents, err = fs.ReadDir(fsys, dir)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -47,8 +52,8 @@ func FindNumberedFiles(dir, prefix, suffix string) ([]uint64, []string, error) {
 	return numbers, names, nil
 }
 
-func FindConsecutiveFiles(dir, prefix, suffix string) ([]string, error) {
-	var numbers, names, err = FindNumberedFiles(dir, prefix, suffix)
+func FindConsecutiveFiles(dir, prefix, suffix string, opts ...Option) ([]string, error) {
+	var numbers, names, err = FindNumberedFiles(dir, prefix, suffix, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -62,8 +67,8 @@ func FindConsecutiveFiles(dir, prefix, suffix string) ([]string, error) {
 
 // FindMaxTimestamp file returns the timestamp and name of the file matching the pattern that has the highest timestamp.
 // If no matching files were found, the cause of the returned error is os.ErrNotExist (see github.com/pkg/errors).
-func FindMaxTimestampFile(dir, prefix, suffix string) (int64, string, error) {
-	var numbers, names, err = FindNumberedFiles(dir, prefix, suffix)
+func FindMaxTimestampFile(dir, prefix, suffix string, opts ...Option) (int64, string, error) {
+	var numbers, names, err = FindNumberedFiles(dir, prefix, suffix, opts...)
 	if err != nil {
 		return math.MinInt64, "", err
 	}
@@ -0,0 +1,202 @@
+package fileutils
+
+import (
+	"expvar"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/infobaleen/errors"
+)
+
+// EventKind is the kind of operation an Event describes.
+type EventKind int
+
+const (
+	// EventOpen is an opened or created file.
+	EventOpen EventKind = iota
+	// EventRead is a read from the operating system, which may fill the read buffer of a File.
+	EventRead
+	// EventWrite is a write to the operating system, which may flush the write buffer of a File.
+	EventWrite
+	// EventSync is a sync of a file or directory.
+	EventSync
+	// EventRename is a rename, including the renames that finalize temporary files.
+	EventRename
+	// EventMmap is a memory mapping of a file.
+	EventMmap
+	// EventMunmap is the removal of a memory mapping.
+	EventMunmap
+	numEventKinds
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventOpen:
+		return "open"
+	case EventRead:
+		return "read"
+	case EventWrite:
+		return "write"
+	case EventSync:
+		return "sync"
+	case EventRename:
+		return "rename"
+	case EventMmap:
+		return "mmap"
+	case EventMunmap:
+		return "munmap"
+	}
+	return "unknown"
+}
+
+// Event describes an operation that was observed.
+type Event struct {
+	Kind EventKind
+	Path string
+	// NewPath is the destination of renames.
+	NewPath string
+	// Bytes is the number of bytes that were read, written or mapped.
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+}
+
+// Observer receives events of files, for example to collect metrics. Observe is called while locks of the file are
+// held, so it must be fast and must not use the file. It must be safe to call concurrently.
+type Observer interface {
+	Observe(event Event)
+}
+
+// ObserverFunc is an Observer implemented by a function.
+type ObserverFunc func(event Event)
+
+func (fn ObserverFunc) Observe(event Event) {
+	fn(event)
+}
+
+// DefaultObserver is used for files that are created or opened afterwards, unless the WithObserver option is used.
+// It is nil by default, so nothing is observed.
+var DefaultObserver Observer
+
+// WithObserver sets the observer that receives the events of the file.
+func WithObserver(obs Observer) Option {
+	return func(o *options) {
+		o.observer = obs
+	}
+}
+
+// observe passes an event that started at start to the observer, if there is one.
+func observe(obs Observer, event Event, start time.Time) {
+	if obs != nil {
+		event.Duration = time.Since(start)
+		obs.Observe(event)
+	}
+}
+
+// fileIO reads and writes the current underlying file of a File, reports it to the observer of the file and updates
+// its checksum. It is used by the buffers of files that have an observer or a checksum and by compressors.
+type fileIO struct {
+	f *File
+}
+
+func (o fileIO) Read(b []byte) (int, error) {
+	var start = time.Now()
+	var n, err = o.f.file.Read(b)
+	observe(o.f.observer, Event{Kind: EventRead, Path: o.f.filepath, Bytes: int64(n), Err: ignoreEOF(err)}, start)
+	return n, err
+}
+
+func (o fileIO) Write(b []byte) (int, error) {
+	var start = time.Now()
+	var n, err = o.f.file.Write(b)
+	observe(o.f.observer, Event{Kind: EventWrite, Path: o.f.filepath, Bytes: int64(n), Err: err}, start)
+	if c := o.f.checksum; c != nil && c.valid {
+		_, _ = c.hash.Write(b[:n])
+	}
+	return n, err
+}
+
+// ignoreEOF returns nil for io.EOF, which is not a failure of reads.
+func ignoreEOF(err error) error {
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// latencyBuckets are the upper bounds of the latency histograms of ExpvarObserver.
+var latencyBuckets = []time.Duration{
+	time.Microsecond, 10 * time.Microsecond, 100 * time.Microsecond,
+	time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond,
+	time.Second, 10 * time.Second,
+}
+
+// ExpvarObserver is an Observer that publishes metrics with the expvar package.
+// For every kind of event, it counts events, errors and bytes and keeps a histogram of latencies,
+// in which every bucket counts the events that took at most its bound and longer than the previous bound:
+//
+//	{"sync": {"count": 2, "errors": 0, "bytes": 0, "latency": {"1µs": 0, ..., "10ms": 2, ..., "inf": 0}}, ...}
+type ExpvarObserver struct {
+	kinds [numEventKinds]*expvar.Map
+}
+
+// expvarMutex serializes NewExpvarObserver, so that concurrent calls with the same name publish a single map.
+var expvarMutex sync.Mutex
+
+// NewExpvarObserver publishes a new ExpvarObserver under the name. If a map was already published under the name,
+// e.g. by another ExpvarObserver, its metrics are reused and updated by both observers. An error is returned if the
+// name is taken by another kind of variable.
+func NewExpvarObserver(name string) (*ExpvarObserver, error) {
+	expvarMutex.Lock()
+	defer expvarMutex.Unlock()
+	var root *expvar.Map
+	switch existing := expvar.Get(name).(type) {
+	case nil:
+		root = expvar.NewMap(name)
+	case *expvar.Map:
+		root = existing
+	default:
+		return nil, errors.Fmt("expvar %q is not a map", name)
+	}
+	var o = new(ExpvarObserver)
+	for k := range o.kinds {
+		if m, ok := root.Get(EventKind(k).String()).(*expvar.Map); ok {
+			o.kinds[k] = m
+			continue
+		}
+		var m = new(expvar.Map).Init()
+		m.Add("count", 0)
+		m.Add("errors", 0)
+		m.Add("bytes", 0)
+		var latency = new(expvar.Map).Init()
+		for _, bound := range latencyBuckets {
+			latency.Add(bound.String(), 0)
+		}
+		latency.Add("inf", 0)
+		m.Set("latency", latency)
+		root.Set(EventKind(k).String(), m)
+		o.kinds[k] = m
+	}
+	return o, nil
+}
+
+func (o *ExpvarObserver) Observe(event Event) {
+	if event.Kind < 0 || event.Kind >= numEventKinds {
+		return
+	}
+	var m = o.kinds[event.Kind]
+	m.Add("count", 1)
+	if event.Err != nil {
+		m.Add("errors", 1)
+	}
+	m.Add("bytes", event.Bytes)
+	var bucket = "inf"
+	for _, bound := range latencyBuckets {
+		if event.Duration <= bound {
+			bucket = bound.String()
+			break
+		}
+	}
+	m.Get("latency").(*expvar.Map).Add(bucket, 1)
+}
@@ -0,0 +1,155 @@
+package fileutils
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Option changes how a file is opened or created. Functions ignore options that don't apply to them.
+type Option func(*options)
+
+type options struct {
+	fs                FS
+	flag              int
+	perm              os.FileMode
+	readBufferSize    int
+	writeBufferSize   int
+	tmpPattern        string
+	tmpDir            string
+	namedTmp          bool
+	durability        Durability
+	leakAction        LeakAction
+	observer          Observer
+	compression       Compression
+	keys              KeyProvider
+	checksum          ChecksumAlgorithm
+	checksumPlacement ChecksumPlacement
+	checkSpace        bool
+	ctx               context.Context
+	progress          func(progress Progress)
+	progressInterval  time.Duration
+	spaceMargin       int64
+	expectedSize      int64
+
+	preservePermissions bool
+	preserveTimes       bool
+	preserveXattrs      bool
+	preserveSparse      bool
+	copyStrategy        *CopyStrategy
+
+	symlinks SymlinkPolicy
+	include  []string
+	exclude  []string
+}
+
+const defaultTmpPattern = "%s.tmp%d"
+
+func newOptions(opts []Option) options {
+	var o = options{
+		fs:          OSFS,
+		flag:        os.O_RDWR,
+		perm:        0666,
+		tmpPattern:  defaultTmpPattern,
+		durability:  DefaultDurability,
+		leakAction:  DefaultLeakAction,
+		observer:    DefaultObserver,
+		compression: compressionDetect,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// ReadOnly opens the file only for reading, e.g. on read-only mounts.
+func ReadOnly() Option {
+	return func(o *options) {
+		o.flag = o.flag&^(os.O_WRONLY|os.O_RDWR) | os.O_RDONLY
+	}
+}
+
+// Append makes all writes append to the end of the file.
+func Append() Option {
+	return func(o *options) {
+		o.flag |= os.O_APPEND
+	}
+}
+
+// CreateIfMissing makes OpenFile create the file if it doesn't exist.
+func CreateIfMissing() Option {
+	return func(o *options) {
+		o.flag |= os.O_CREATE
+	}
+}
+
+// Exclusive makes OpenFile create the file and fail if it already exists.
+func Exclusive() Option {
+	return func(o *options) {
+		o.flag |= os.O_CREATE | os.O_EXCL
+	}
+}
+
+// Perm sets the permission bits (before umask) of created files. The default is 0666.
+func Perm(perm os.FileMode) Option {
+	return func(o *options) {
+		o.perm = perm
+	}
+}
+
+// BufferSize sets the size of both the read and the write buffer.
+func BufferSize(size int) Option {
+	return func(o *options) {
+		o.readBufferSize = size
+		o.writeBufferSize = size
+	}
+}
+
+// ReadBufferSize sets the size of the read buffer.
+func ReadBufferSize(size int) Option {
+	return func(o *options) {
+		o.readBufferSize = size
+	}
+}
+
+// WriteBufferSize sets the size of the write buffer.
+func WriteBufferSize(size int) Option {
+	return func(o *options) {
+		o.writeBufferSize = size
+	}
+}
+
+// TmpPattern sets the name of named temporary files. The pattern is passed to fmt.Sprintf together with the
+// name of the final file and a random number. The default is "%s.tmp%d".
+func TmpPattern(pattern string) Option {
+	return func(o *options) {
+		o.tmpPattern = pattern
+	}
+}
+
+// HiddenTmp names temporary files ".<name>.tmp<random>", so they are hidden from directory listings.
+func HiddenTmp() Option {
+	return TmpPattern("." + defaultTmpPattern)
+}
+
+// TmpDir creates temporary files in dir instead of next to the final file.
+// The directory must be on the same filesystem as the final file.
+func TmpDir(dir string) Option {
+	return func(o *options) {
+		o.tmpDir = dir
+	}
+}
+
+// NamedTmp always creates temporary files with a name, even if the filesystem supports anonymous files.
+func NamedTmp() Option {
+	return func(o *options) {
+		o.namedTmp = true
+	}
+}
+
+// WithDurability sets the durability of the file, overriding DefaultDurability.
+func WithDurability(d Durability) Option {
+	return func(o *options) {
+		o.durability = d
+	}
+}
@@ -0,0 +1,49 @@
+package fileutils
+
+import (
+	"time"
+)
+
+// Progress describes how far an operation has come.
+type Progress struct {
+	// Done is the number of bytes that were processed.
+	Done int64
+	// Total is the number of bytes of the whole operation, or -1 if it is unknown, e.g. for Untar.
+	Total int64
+	// Path is the file that is processed.
+	Path string
+}
+
+// WithProgress makes Copy, TarWriter.AddPath, Untar and WriteBinaryFile call fn with their progress, at most once per
+// interval and once when they complete successfully. It is called from the goroutine of the operation, which waits
+// for it to return.
+func WithProgress(fn func(progress Progress), interval time.Duration) Option {
+	return func(o *options) {
+		o.progress = fn
+		o.progressInterval = interval
+	}
+}
+
+// progressReporter throttles progress reports.
+type progressReporter struct {
+	fn       func(progress Progress)
+	interval time.Duration
+	last     time.Time
+	current  Progress
+}
+
+func (p *progressReporter) add(n int64) {
+	p.current.Done += n
+	if now := time.Now(); now.Sub(p.last) >= p.interval {
+		p.last = now
+		p.fn(p.current)
+	}
+}
+
+func (p *progressReporter) finish() {
+	if p.current.Total >= 0 {
+		// e.g. holes skipped by sparse copies are not counted while copying
+		p.current.Done = p.current.Total
+	}
+	p.fn(p.current)
+}
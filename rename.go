@@ -5,29 +5,118 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
-func ChangeName(oldPath, newName string) (string, error) {
-	return Move(oldPath, filepath.Join(filepath.Dir(oldPath), newName))
+func ChangeName(oldPath, newName string, opts ...Option) (string, error) {
+	return Move(oldPath, filepath.Join(filepath.Dir(oldPath), newName), opts...)
 }
 
-func Move(oldPath, newPath string) (string, error) {
-	var err = os.Rename(oldPath, newPath)
+// Move renames a file. If the new path is on another filesystem, the file is copied to a temporary file that is
+// synced and finalized at the new path, keeping mode and modification time, before the old file is removed.
+// Errors during copying are of type *MoveError.
+func Move(oldPath, newPath string, opts ...Option) (string, error) {
+	var o = newOptions(opts)
+	var _, err = move(o.fs, o.observer, oldPath, newPath)
 	if err != nil {
 		return oldPath, err
 	}
 	return newPath, nil
 }
 
-func ExtendName(currentPath, prefix, suffix string) (string, error) {
+// move is like Move and additionally reports if the file was copied.
+func move(fs FS, obs Observer, oldPath, newPath string) (bool, error) {
+	var start = time.Now()
+	var copied bool
+	var err = fs.Rename(oldPath, newPath)
+	if linkErr, ok := err.(*os.LinkError); ok && linkErr.Err == syscall.EXDEV {
+		copied, err = true, moveByCopy(fs, oldPath, newPath)
+	}
+	observe(obs, Event{Kind: EventRename, Path: oldPath, NewPath: newPath, Err: err}, start)
+	return copied, err
+}
+
+// MovePhase identifies the step of a Move across filesystems that failed.
+type MovePhase string
+
+const (
+	// MovePhaseCopy means that the file could not be copied. The destination was not changed.
+	MovePhaseCopy MovePhase = "copy"
+	// MovePhaseSync means that the copy could not be synced and finalized. The destination was not changed.
+	MovePhaseSync MovePhase = "sync"
+	// MovePhaseRemove means that the old file could not be removed after the new file was finalized,
+	// so both exist.
+	MovePhaseRemove MovePhase = "remove"
+)
+
+// MoveError is returned by Move if moving a file to another filesystem failed.
+type MoveError struct {
+	Phase MovePhase
+	Old   string
+	New   string
+	Err   error
+}
+
+func (err *MoveError) Error() string {
+	return fmt.Sprintf("moving %q to %q failed in phase %s: %v", err.Old, err.New, err.Phase, err.Err)
+}
+
+func (err *MoveError) Cause() error {
+	return err.Err
+}
+
+func moveByCopy(fs FS, oldPath, newPath string) error {
+	var moveErr = func(phase MovePhase, err error) error {
+		return &MoveError{Phase: phase, Old: oldPath, New: newPath, Err: err}
+	}
+	var src, err = fs.OpenFile(oldPath, os.O_RDONLY, 0)
+	if err != nil {
+		return moveErr(MovePhaseCopy, err)
+	}
+	defer src.Close()
+	var info os.FileInfo
+	info, err = src.Stat()
+	if err != nil {
+		return moveErr(MovePhaseCopy, err)
+	} else if !info.Mode().IsRegular() {
+		return moveErr(MovePhaseCopy, fmt.Errorf("%q is not a regular file", oldPath))
+	}
+
+	var dst *File
+	dst, err = CreateFileTmp(newPath, WithFS(fs), WithDurability(DurabilityFull))
+	if err != nil {
+		return moveErr(MovePhaseCopy, err)
+	}
+	defer dst.RemoveIfTmp()
+	err = dst.copyFrom(src, newOptions([]Option{PreservePermissions(), PreserveTimes()}), nil)
+	if err != nil {
+		return moveErr(MovePhaseCopy, err)
+	}
+	err = dst.Close()
+	if err != nil {
+		return moveErr(MovePhaseSync, err)
+	}
+
+	err = fs.Remove(oldPath)
+	if err == nil {
+		err = syncDir(fs, filepath.Dir(oldPath))
+	}
+	if err != nil {
+		return moveErr(MovePhaseRemove, err)
+	}
+	return nil
+}
+
+func ExtendName(currentPath, prefix, suffix string, opts ...Option) (string, error) {
 	var file = filepath.Base(currentPath)
-	return ChangeName(currentPath, prefix+file+suffix)
+	return ChangeName(currentPath, prefix+file+suffix, opts...)
 }
 
-func TrimName(currentPath, prefix, suffix string) (string, error) {
+func TrimName(currentPath, prefix, suffix string, opts ...Option) (string, error) {
 	var file = filepath.Base(currentPath)
 	if !strings.HasPrefix(file, prefix) {
 		return currentPath, fmt.Errorf(`"%s" does not have prefix "%s" and suffix "%s"`, file, prefix, suffix)
 	}
-	return ChangeName(currentPath, file[len(prefix):len(file)-len(suffix)])
+	return ChangeName(currentPath, file[len(prefix):len(file)-len(suffix)], opts...)
 }
@@ -0,0 +1,31 @@
+//go:build linux
+// +build linux
+
+package fileutils
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// osRenameNoReplace renames oldPath to newPath and fails if newPath exists.
+func osRenameNoReplace(oldPath, newPath string) error {
+	var err = unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath, unix.RENAME_NOREPLACE)
+	if err == unix.EINVAL || err == unix.ENOSYS {
+		// the filesystem or kernel doesn't support renameat2 flags
+		return renameNoReplaceLink(OSFS, oldPath, newPath)
+	} else if err != nil {
+		return &os.LinkError{Op: "renameat2", Old: oldPath, New: newPath, Err: err}
+	}
+	return nil
+}
+
+// osRenameExchange atomically swaps the files at both paths.
+func osRenameExchange(oldPath, newPath string) error {
+	var err = unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath, unix.RENAME_EXCHANGE)
+	if err != nil {
+		return &os.LinkError{Op: "renameat2", Old: oldPath, New: newPath, Err: err}
+	}
+	return nil
+}
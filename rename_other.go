@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package fileutils
+
+import (
+	"github.com/infobaleen/errors"
+)
+
+func osRenameNoReplace(oldPath, newPath string) error {
+	return renameNoReplaceLink(OSFS, oldPath, newPath)
+}
+
+func osRenameExchange(oldPath, newPath string) error {
+	return errors.Fmt("atomic exchange is not supported on this platform")
+}
@@ -0,0 +1,251 @@
+package fileutils
+
+import (
+	"io"
+	"os"
+
+	"github.com/infobaleen/errors"
+)
+
+// errUnsupported is returned by platform specific functions if the platform or filesystem doesn't support them,
+// so a fallback is used.
+const errUnsupported = constError("operation is not supported")
+
+// Region is a range of bytes in a file.
+type Region struct {
+	Offset int64
+	Length int64
+}
+
+// Preallocate allocates disk space for the range, extending the file if necessary, so that writing the range, also
+// through a memory mapping, doesn't fail for lack of space. Existing contents are kept. Where the filesystem doesn't
+// support allocation, holes in the range are filled with zeros.
+func (f *File) Preallocate(offset, length int64) error {
+	return f.withRange(offset, length, func(file FSFile) error {
+		var err error = errUnsupported
+		if osf, ok := file.(*os.File); ok {
+			err = osAllocate(osf, offset, length)
+		}
+		if err == errUnsupported {
+			err = fillHoles(file, offset, length)
+		}
+		return err
+	})
+}
+
+// PunchHole deallocates the range, which then reads as zeros, to reclaim disk space. The size of the file doesn't
+// change. Where the filesystem doesn't support holes, the range is overwritten with zeros instead.
+func (f *File) PunchHole(offset, length int64) error {
+	return f.withRange(offset, length, func(file FSFile) error {
+		var err error = errUnsupported
+		if osf, ok := file.(*os.File); ok {
+			err = osPunchHole(osf, offset, length)
+		}
+		if err == errUnsupported {
+			var info os.FileInfo
+			info, err = file.Stat()
+			if err == nil && offset < info.Size() {
+				err = writeZeros(file, offset, min64(length, info.Size()-offset))
+			}
+		}
+		return err
+	})
+}
+
+// ZeroRange sets the range to zeros, extending the file if necessary. Unlike PunchHole, the range stays allocated.
+// Where the filesystem supports it, no data is written.
+func (f *File) ZeroRange(offset, length int64) error {
+	return f.withRange(offset, length, func(file FSFile) error {
+		var err error = errUnsupported
+		if osf, ok := file.(*os.File); ok {
+			err = osZeroRange(osf, offset, length)
+		}
+		if err == errUnsupported {
+			err = writeZeros(file, offset, length)
+		}
+		return err
+	})
+}
+
+// withRange validates the range and calls fn with the underlying file, unless the range is empty.
+func (f *File) withRange(offset, length int64, fn func(file FSFile) error) error {
+	if offset < 0 || length < 0 {
+		return errors.Fmt("invalid range %d+%d", offset, length)
+	} else if length == 0 {
+		return nil
+	}
+	return f.withFile(fn)
+}
+
+// SeekData returns the offset of the first data at or after offset. It returns io.EOF if there is no more data.
+// Where the filesystem doesn't support holes, the whole file is data. The offset used by Read and Write doesn't change.
+func (f *File) SeekData(offset int64) (int64, error) {
+	return f.seekRegion(offset, seekDataIn)
+}
+
+// SeekHole returns the offset of the first hole at or after offset. The end of the file counts as a hole.
+// Where the filesystem doesn't support holes, the only hole is the end. The offset used by Read and Write doesn't
+// change.
+func (f *File) SeekHole(offset int64) (int64, error) {
+	return f.seekRegion(offset, seekHoleIn)
+}
+
+func (f *File) seekRegion(offset int64, seek func(file FSFile, offset int64) (int64, error)) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.ifClosedError(); err != nil {
+		return 0, err
+	}
+	if err := f.ifEncodedError(); err != nil {
+		return 0, err
+	}
+	if err := f.emptyBuffers(); err != nil {
+		return 0, err
+	}
+	return seek(f.file, offset)
+}
+
+// DataRegions returns an iterator over the regions of the file that contain data, skipping holes.
+// The file should not be changed during the iteration.
+func (f *File) DataRegions() *RegionIterator {
+	return &RegionIterator{f: f}
+}
+
+// RegionIterator iterates over the data regions of a file:
+//
+//	var it = f.DataRegions()
+//	for it.Next() {
+//		var region = it.Region()
+//		...
+//	}
+//	if it.Err() != nil {
+//		...
+//	}
+type RegionIterator struct {
+	f      *File
+	offset int64
+	region Region
+	err    error
+	done   bool
+}
+
+// Next advances to the next region. It returns false at the end of the file or after an error.
+func (it *RegionIterator) Next() bool {
+	if it.done {
+		return false
+	}
+	var data, err = it.f.SeekData(it.offset)
+	var hole int64
+	if err == nil {
+		hole, err = it.f.SeekHole(data)
+	}
+	if err != nil {
+		if err != io.EOF {
+			it.err = err
+		}
+		it.done = true
+		return false
+	}
+	it.region = Region{Offset: data, Length: hole - data}
+	it.offset = hole
+	return true
+}
+
+// Region returns the current region.
+func (it *RegionIterator) Region() Region {
+	return it.region
+}
+
+// Err returns the error that ended the iteration, if any.
+func (it *RegionIterator) Err() error {
+	return it.err
+}
+
+func seekDataIn(file FSFile, offset int64) (int64, error) {
+	var err error = errUnsupported
+	var data int64
+	if osf, ok := file.(*os.File); ok {
+		data, err = osSeekData(osf, offset)
+	}
+	if err != errUnsupported {
+		return data, err
+	}
+	var info os.FileInfo
+	info, err = file.Stat()
+	if err != nil {
+		return 0, err
+	} else if offset >= info.Size() {
+		return 0, io.EOF
+	}
+	return offset, nil
+}
+
+func seekHoleIn(file FSFile, offset int64) (int64, error) {
+	var err error = errUnsupported
+	var hole int64
+	if osf, ok := file.(*os.File); ok {
+		hole, err = osSeekHole(osf, offset)
+	}
+	if err != errUnsupported {
+		return hole, err
+	}
+	var info os.FileInfo
+	info, err = file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return max64(offset, info.Size()), nil
+}
+
+// fillHoles writes zeros to the holes in the range, including the part after the end of the file.
+func fillHoles(file FSFile, offset, length int64) error {
+	var end = offset + length
+	for offset < end {
+		var hole, err = seekHoleIn(file, offset)
+		if err != nil {
+			return err
+		} else if hole >= end {
+			return nil
+		}
+		var data int64
+		data, err = seekDataIn(file, hole)
+		if err == io.EOF || (err == nil && data > end) {
+			data = end
+		} else if err != nil {
+			return err
+		}
+		err = writeZeros(file, hole, data-hole)
+		if err != nil {
+			return err
+		}
+		offset = data
+	}
+	return nil
+}
+
+func writeZeros(file FSFile, offset, length int64) error {
+	var zeros = make([]byte, min64(length, 64<<10))
+	for length > 0 {
+		var n, err = file.WriteAt(zeros[:min64(length, int64(len(zeros)))], offset)
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+		length -= int64(n)
+	}
+	return nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
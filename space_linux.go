@@ -0,0 +1,81 @@
+//go:build linux
+// +build linux
+
+package fileutils
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func osAllocate(f *os.File, offset, length int64) error {
+	return fallocate(f, 0, offset, length)
+}
+
+func osPunchHole(f *os.File, offset, length int64) error {
+	return fallocate(f, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+}
+
+func osZeroRange(f *os.File, offset, length int64) error {
+	var err = fallocate(f, unix.FALLOC_FL_ZERO_RANGE, offset, length)
+	if err == errUnsupported {
+		// e.g. tmpfs only supports punching holes, which can be allocated again
+		err = osPunchHole(f, offset, length)
+		if err == nil {
+			err = osAllocate(f, offset, length)
+		}
+	}
+	return err
+}
+
+func fallocate(f *os.File, mode uint32, offset, length int64) error {
+	var err = unix.Fallocate(int(f.Fd()), mode, offset, length)
+	if isUnsupported(err) {
+		return errUnsupported
+	} else if err != nil {
+		return os.NewSyscallError("fallocate", err)
+	}
+	return nil
+}
+
+func osSeekData(f *os.File, offset int64) (int64, error) {
+	var data, err = seekKeepOffset(f, offset, seekData)
+	if err == unix.ENXIO {
+		return 0, io.EOF
+	}
+	return data, err
+}
+
+func osSeekHole(f *os.File, offset int64) (int64, error) {
+	var hole, err = seekKeepOffset(f, offset, seekHole)
+	if err == unix.ENXIO {
+		// the offset is at or after the end of the file
+		return offset, nil
+	}
+	return hole, err
+}
+
+// seekKeepOffset seeks with SEEK_DATA or SEEK_HOLE and restores the previous offset of the file.
+func seekKeepOffset(f *os.File, offset int64, whence int) (int64, error) {
+	var current, err = unix.Seek(int(f.Fd()), 0, io.SeekCurrent)
+	if err != nil {
+		return 0, os.NewSyscallError("lseek", err)
+	}
+	var result int64
+	result, err = unix.Seek(int(f.Fd()), offset, whence)
+	if err == unix.EINVAL {
+		// holes are not supported by the filesystem
+		return 0, errUnsupported
+	} else if err == unix.ENXIO {
+		return 0, err
+	} else if err != nil {
+		return 0, os.NewSyscallError("lseek", err)
+	}
+	_, err = unix.Seek(int(f.Fd()), current, io.SeekStart)
+	if err != nil {
+		return 0, os.NewSyscallError("lseek", err)
+	}
+	return result, nil
+}
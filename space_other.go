@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package fileutils
+
+import (
+	"os"
+)
+
+func osAllocate(f *os.File, offset, length int64) error {
+	return errUnsupported
+}
+
+func osPunchHole(f *os.File, offset, length int64) error {
+	return errUnsupported
+}
+
+func osZeroRange(f *os.File, offset, length int64) error {
+	return errUnsupported
+}
+
+func osSeekData(f *os.File, offset int64) (int64, error) {
+	return 0, errUnsupported
+}
+
+func osSeekHole(f *os.File, offset int64) (int64, error) {
+	return 0, errUnsupported
+}
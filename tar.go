@@ -5,7 +5,6 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
@@ -13,37 +12,47 @@ import (
 	"github.com/infobaleen/errors"
 )
 
-func Untar(dir string, r io.Reader) error {
-	var err = os.MkdirAll(dir, 0777)
+func Untar(dir string, r io.Reader, opts ...Option) error {
+	var o = newOptions(opts)
+	var fs = o.fs
+	var err = mkdirAll(fs, dir, 0777)
 	err = errors.WithTrace(err)
 	if err != nil {
 		return err
 	}
 	var tr = tar.NewReader(r)
+	var m = newMonitor(o, dir, -1)
 	for {
 		var header, err = tr.Next()
 		err = errors.WithTrace(err)
 		if errors.Cause(err) == io.EOF {
+			m.finish()
 			return nil
 		} else if err != nil {
 			return err
 		}
+		var target = path.Join(dir, header.Name)
+		m.setPath(target)
+		if err = m.check(); err != nil {
+			return errors.WithTrace(err)
+		}
 		switch header.Typeflag {
 		case tar.TypeDir:
-			err = os.Mkdir(path.Join(dir, header.Name), 0777)
+			err = fs.Mkdir(target, 0777)
 			err = errors.WithTrace(err)
 		case tar.TypeReg:
 			err = func() error {
-				var f, err = os.OpenFile(path.Join(dir, header.Name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0777)
+				var f, err = fs.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0777)
 				err = errors.WithTrace(err)
 				if err != nil {
 					return err
 				}
 				defer f.Close()
-				_, err = io.Copy(f, tr)
+				_, err = io.Copy(f, monitoredReader{tr, m})
 				err = errors.WithTrace(err)
 				if err != nil {
-					return err
+					// the partial file is removed
+					return appendError(err, f.Close(), fs.Remove(target))
 				}
 				return errors.WithTrace(f.Close())
 			}()
@@ -143,21 +152,56 @@ func (tw *TarWriter) AddTaggedStruct(archivePrefix string, v interface{}) error
 //	tw.AddDir("top")
 //	tw.AddDir("top/dir")
 //	tw.Add("top/dir","path/to/dir")
-func (tw *TarWriter) AddPath(archivePrefix, diskPath string) error {
-	var info, err = os.Stat(diskPath)
+func (tw *TarWriter) AddPath(archivePrefix, diskPath string, opts ...Option) error {
+	var o = newOptions(opts)
+	var info, err = o.fs.Stat(diskPath)
 	if err != nil {
 		return err
 	}
+	var total = info.Size()
+	if info.IsDir() && o.progress != nil {
+		total, err = treeSize(o.fs, diskPath)
+		if err != nil {
+			return err
+		}
+	}
+	var m = newMonitor(o, diskPath, total)
 	if info.IsDir() {
-		return tw.addDir(archivePrefix, diskPath)
+		err = tw.addDir(o.fs, m, archivePrefix, diskPath)
 	} else if info.Mode().IsRegular() {
-		return tw.addFile(path.Join(archivePrefix, info.Name()), diskPath, info.Size())
+		err = tw.addFile(o.fs, m, path.Join(archivePrefix, info.Name()), diskPath, info.Size())
+	} else {
+		return errors.Fmt("\"%s\" is neither directory nor regular file", diskPath)
+	}
+	if err == nil {
+		m.finish()
+	}
+	return err
+}
+
+// treeSize returns the total size of the regular files in a directory and its subdirectories.
+func treeSize(fs FS, dir string) (int64, error) {
+	var infos, err = fs.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, info := range infos {
+		if info.IsDir() {
+			var size, err = treeSize(fs, path.Join(dir, info.Name()))
+			if err != nil {
+				return 0, err
+			}
+			total += size
+		} else if info.Mode().IsRegular() {
+			total += info.Size()
+		}
 	}
-	return errors.Fmt("\"%s\" is neither directory nor regular file", diskPath)
+	return total, nil
 }
 
-func (tw *TarWriter) addDir(prefix, dir string) error {
-	var infos, err = ioutil.ReadDir(dir)
+func (tw *TarWriter) addDir(fs FS, m *monitor, prefix, dir string) error {
+	var infos, err = fs.ReadDir(dir)
 	if err != nil {
 		return err
 	}
@@ -165,14 +209,18 @@ func (tw *TarWriter) addDir(prefix, dir string) error {
 		var name = info.Name()
 		var diskPath = path.Join(dir, name)
 		var archivePath = path.Join(prefix, name)
+		m.setPath(diskPath)
+		if err = m.check(); err != nil {
+			return err
+		}
 		if info.IsDir() {
 			err = tw.AddDir(archivePath)
 			if err != nil {
 				return err
 			}
-			err = tw.addDir(archivePath, diskPath)
+			err = tw.addDir(fs, m, archivePath, diskPath)
 		} else if info.Mode().IsRegular() {
-			err = tw.addFile(archivePath, diskPath, info.Size())
+			err = tw.addFile(fs, m, archivePath, diskPath, info.Size())
 		}
 		if err != nil {
 			return err
@@ -181,11 +229,11 @@ func (tw *TarWriter) addDir(prefix, dir string) error {
 	return nil
 }
 
-func (tw *TarWriter) addFile(archivePath, diskPath string, size int64) error {
-	var f, err = os.Open(diskPath)
+func (tw *TarWriter) addFile(fs FS, m *monitor, archivePath, diskPath string, size int64) error {
+	var f, err = fs.OpenFile(diskPath, os.O_RDONLY, 0)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	return tw.AddFile(archivePath, size, f)
+	return tw.AddFile(archivePath, size, monitoredReader{f, m})
 }
@@ -1,12 +1,25 @@
 package fileutils
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/infobaleen/errors"
 	"github.com/matryer/is"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestBufferedIo(t *testing.T) {
@@ -91,3 +104,1118 @@ func TestReadJsonFileAppend(t *testing.T) {
 		is.Equal(i+1, v)
 	}
 }
+
+func TestCreateFileTmp(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var target = path.Join(tmpDir, "test")
+	is.NoErr(WriteFile(target, []byte("old")))
+
+	var f *File
+	f, err = CreateFileTmp(target)
+	is.NoErr(err)
+	_, err = f.Write([]byte("new"))
+	is.NoErr(err)
+	is.NoErr(f.Close())
+	is.NoErr(f.RemoveIfTmp())
+
+	var content []byte
+	content, err = ReadFile(target)
+	is.NoErr(err)
+	is.Equal(string(content), "new")
+	var infos []os.FileInfo
+	infos, err = ioutil.ReadDir(tmpDir)
+	is.NoErr(err)
+	is.Equal(len(infos), 1)
+
+	f, err = CreateFileTmp(target)
+	is.NoErr(err)
+	is.NoErr(f.RemoveIfTmp())
+	infos, err = ioutil.ReadDir(tmpDir)
+	is.NoErr(err)
+	is.Equal(len(infos), 1)
+
+	// on Linux, the temporary file has no name until it is finalized
+	if runtime.GOOS == "linux" {
+		var dir = path.Join(tmpDir, "anonymous")
+		is.NoErr(os.Mkdir(dir, 0777))
+		f, err = CreateFileTmp(path.Join(dir, "test"))
+		is.NoErr(err)
+		defer f.RemoveIfTmp()
+		infos, err = ioutil.ReadDir(dir)
+		is.NoErr(err)
+		is.Equal(len(infos), 0)
+		is.NoErr(f.Finalize())
+		infos, err = ioutil.ReadDir(dir)
+		is.NoErr(err)
+		is.Equal(len(infos), 1)
+		is.Equal(infos[0].Name(), "test")
+		is.NoErr(f.Close())
+	}
+}
+
+func TestFinalizeModes(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var target = path.Join(tmpDir, "test")
+	is.NoErr(WriteFile(target, []byte("old")))
+
+	var f *File
+	f, err = CreateFileTmp(target)
+	is.NoErr(err)
+	defer f.RemoveIfTmp()
+	_, err = f.Write([]byte("new"))
+	is.NoErr(err)
+	err = f.FinalizeNoReplace()
+	is.True(os.IsExist(err))
+
+	var old *File
+	old, err = f.FinalizeExchange()
+	is.NoErr(err)
+	is.NoErr(f.Close())
+	var content []byte
+	content, err = ReadFile(target)
+	is.NoErr(err)
+	is.Equal(string(content), "new")
+
+	is.NoErr(old.Close())
+	content, err = ReadFile(target)
+	is.NoErr(err)
+	is.Equal(string(content), "old")
+}
+
+func TestFileOptions(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var target = path.Join(tmpDir, "test")
+
+	var f *File
+	f, err = CreateFileTmp(target, NamedTmp(), HiddenTmp(), BufferSize(1<<20), Perm(0600))
+	is.NoErr(err)
+	var infos []os.FileInfo
+	infos, err = ioutil.ReadDir(tmpDir)
+	is.NoErr(err)
+	is.Equal(len(infos), 1)
+	var _, isTmp = IsNumberedName(infos[0].Name(), ".test.tmp", "")
+	is.True(isTmp)
+	_, err = f.Write([]byte("content"))
+	is.NoErr(err)
+	is.NoErr(f.Close())
+
+	f, err = OpenFile(target, ReadOnly())
+	is.NoErr(err)
+	defer f.Close()
+	var info os.FileInfo
+	info, err = os.Stat(target)
+	is.NoErr(err)
+	is.Equal(info.Mode().Perm(), os.FileMode(0600))
+	_, err = f.Write([]byte("more"))
+	is.NoErr(err)
+	is.True(f.Sync() != nil)
+
+	_, err = OpenFile(target, Exclusive())
+	is.True(os.IsExist(err))
+}
+
+func TestPositionalIo(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var f *File
+	f, err = CreateFile(path.Join(tmpDir, "test"))
+	is.NoErr(err)
+	defer f.Close()
+
+	_, err = f.Write([]byte{0, 1, 2, 3, 4, 5, 6, 7})
+	is.NoErr(err)
+	var oneByte [1]byte
+	_, err = f.ReadAt(oneByte[:], 4)
+	is.NoErr(err)
+	is.Equal(oneByte[0], byte(4))
+	_, err = f.Seek(0, 0)
+	is.NoErr(err)
+	_, err = f.Read(oneByte[:])
+	is.NoErr(err)
+	is.Equal(oneByte[0], byte(0))
+	_, err = f.WriteAt([]byte{10}, 1)
+	is.NoErr(err)
+	_, err = f.Read(oneByte[:])
+	is.NoErr(err)
+	is.Equal(oneByte[0], byte(10))
+	_, err = f.Write([]byte{12})
+	is.NoErr(err)
+	_, err = f.ReadAt(oneByte[:], 2)
+	is.NoErr(err)
+	is.Equal(oneByte[0], byte(12))
+	_, err = f.ReadAt(oneByte[:], 8)
+	is.Equal(err, io.EOF)
+}
+
+func TestConcurrentIo(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var f *File
+	f, err = CreateFileTmp(path.Join(tmpDir, "test"))
+	is.NoErr(err)
+	defer f.RemoveIfTmp()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				var _, err = f.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+				is.NoErr(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			var buf [8]byte
+			for j := 0; j < 100; j++ {
+				var _, err = f.ReadAt(buf[:], 0)
+				is.True(err == nil || err == io.EOF)
+				_, err = f.Size()
+				is.NoErr(err)
+				_, err = f.Seek(0, 2)
+				is.NoErr(err)
+			}
+		}()
+	}
+	wg.Wait()
+	var size int64
+	size, err = f.Size()
+	is.NoErr(err)
+	is.Equal(size, int64(4*100*8))
+	is.NoErr(f.Close())
+}
+
+func TestCleanupTmpFiles(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	is.NoErr(os.Mkdir(path.Join(tmpDir, "sub"), 0777))
+	var target = path.Join(tmpDir, "sub", "test")
+	is.NoErr(WriteFile(target, nil))
+	is.NoErr(WriteFile(path.Join(tmpDir, "sub", ".test.tmp123"), nil))
+	is.NoErr(WriteFile(path.Join(tmpDir, "test.tmp99999"), nil))
+
+	var f *File
+	f, err = CreateFileTmp(target, NamedTmp())
+	is.NoErr(err)
+	defer f.RemoveIfTmp()
+	var removed []string
+	removed, err = CleanupTmpFilesRecursive(tmpDir, -time.Second)
+	is.NoErr(err)
+	var expected = []string{path.Join(tmpDir, "sub", ".test.tmp123")}
+	if !tmpLocks {
+		expected = nil
+	}
+	is.Equal(removed, expected)
+	is.NoErr(f.RemoveIfTmp())
+
+	var infos []os.FileInfo
+	infos, err = ioutil.ReadDir(path.Join(tmpDir, "sub"))
+	is.NoErr(err)
+	is.Equal(len(infos), 1)
+}
+
+func TestMoveAcrossFilesystems(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var otherDir string
+	otherDir, err = ioutil.TempDir("/dev/shm", "")
+	if err != nil {
+		t.Skip("no tmpfs available:", err)
+	}
+	defer os.RemoveAll(otherDir)
+
+	var oldPath = path.Join(otherDir, "test")
+	is.NoErr(WriteFile(oldPath, []byte("content")))
+	is.NoErr(os.Chmod(oldPath, 0640))
+	var mtime = time.Now().Add(-time.Hour).Truncate(time.Second)
+	is.NoErr(os.Chtimes(oldPath, mtime, mtime))
+
+	var f *File
+	f, err = OpenFile(oldPath)
+	is.NoErr(err)
+	defer f.Close()
+	var newPath = path.Join(tmpDir, "test")
+	is.NoErr(f.Move(newPath))
+	is.Equal(f.Path(), newPath)
+	var exists bool
+	exists, err = Exists(oldPath)
+	is.NoErr(err)
+	is.True(!exists)
+	var info os.FileInfo
+	info, err = os.Stat(newPath)
+	is.NoErr(err)
+	is.Equal(info.Mode().Perm(), os.FileMode(0640))
+	is.True(info.ModTime().Equal(mtime))
+	_, err = f.Write([]byte("!"))
+	is.NoErr(err)
+	is.NoErr(f.Close())
+	var content []byte
+	content, err = ReadFile(newPath)
+	is.NoErr(err)
+	is.Equal(string(content), "!ontent")
+
+	_, err = Move(path.Join(otherDir, "missing"), newPath)
+	is.True(os.IsNotExist(errors.Cause(err)))
+}
+
+func TestCopy(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var oldPath = path.Join(tmpDir, "old")
+	var f *File
+	f, err = CreateFile(oldPath, Perm(0600))
+	is.NoErr(err)
+	_, err = f.WriteAt([]byte("start"), 0)
+	is.NoErr(err)
+	_, err = f.WriteAt([]byte("end"), 1<<20)
+	is.NoErr(err)
+	var hole int64
+	hole, err = f.SeekHole(0)
+	is.NoErr(err)
+	// holes can only be preserved if the filesystem supports them
+	var holes = hole < 1<<20
+	is.NoErr(f.Close())
+	var mtime = time.Now().Add(-time.Hour).Truncate(time.Second)
+	is.NoErr(os.Chtimes(oldPath, mtime, mtime))
+
+	for _, sparse := range []bool{false, true} {
+		var newPath = path.Join(tmpDir, "new")
+		var strategy = CopyStrategy(-1)
+		var opts = []Option{PreservePermissions(), PreserveTimes(), ReportCopyStrategy(&strategy)}
+		if sparse {
+			opts = append(opts, PreserveSparse())
+		}
+		is.NoErr(Copy(oldPath, newPath, opts...))
+		is.True(strategy != CopyStrategy(-1))
+		var oldContent, newContent []byte
+		oldContent, err = ReadFile(oldPath)
+		is.NoErr(err)
+		newContent, err = ReadFile(newPath)
+		is.NoErr(err)
+		is.Equal(oldContent, newContent)
+		var info os.FileInfo
+		info, err = os.Stat(newPath)
+		is.NoErr(err)
+		is.Equal(info.Mode().Perm(), os.FileMode(0600))
+		is.True(info.ModTime().Equal(mtime))
+		if sparse && holes {
+			f, err = OpenFile(newPath)
+			is.NoErr(err)
+			hole, err = f.SeekHole(0)
+			is.NoErr(err)
+			is.True(hole < 1<<20)
+			is.NoErr(f.Close())
+		}
+	}
+}
+
+func TestCopyDir(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var src = path.Join(tmpDir, "src")
+	is.NoErr(os.MkdirAll(path.Join(src, "a", "b"), 0777))
+	is.NoErr(WriteFile(path.Join(src, "a", "b", "file.txt"), []byte("content")))
+	is.NoErr(WriteFile(path.Join(src, "a", "file.log"), nil))
+	is.NoErr(os.Symlink("a/b/file.txt", path.Join(src, "link")))
+
+	var dst = path.Join(tmpDir, "dst")
+	is.NoErr(CopyDir(src, dst, Exclude("*.log")))
+	var content []byte
+	content, err = ReadFile(path.Join(dst, "link"))
+	is.NoErr(err)
+	is.Equal(string(content), "content")
+	var exists bool
+	exists, err = Exists(path.Join(dst, "a", "file.log"))
+	is.NoErr(err)
+	is.True(!exists)
+
+	err = CopyDir(src, dst, Symlinks(SymlinksFollow))
+	is.True(os.IsExist(err))
+	var infos []os.FileInfo
+	infos, err = ioutil.ReadDir(tmpDir)
+	is.NoErr(err)
+	is.Equal(len(infos), 2)
+}
+
+func TestCreateDirTmp(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var target = path.Join(tmpDir, "dir")
+
+	var d *Dir
+	d, err = CreateDirTmp(target)
+	is.NoErr(err)
+	is.NoErr(WriteTaggedStructFiles(d.Path(), original))
+	is.NoErr(d.FinalizeNoReplace())
+	is.Equal(d.Path(), target)
+
+	d, err = CreateDirTmp(target)
+	is.NoErr(err)
+	defer d.RemoveIfTmp()
+	is.NoErr(WriteTaggedStructFiles(d.Path(), S{3, 4}))
+	err = d.FinalizeNoReplace()
+	is.True(os.IsExist(err))
+	var old *Dir
+	old, err = d.FinalizeExchange()
+	is.NoErr(err)
+	var check S
+	is.NoErr(PopulateTaggedStruct(target, &check))
+	is.Equal(check, S{3, 4})
+	is.NoErr(PopulateTaggedStruct(old.Path(), &check))
+	is.Equal(check, original)
+	is.NoErr(old.RemoveIfTmp())
+
+	var infos []os.FileInfo
+	infos, err = ioutil.ReadDir(tmpDir)
+	is.NoErr(err)
+	is.Equal(len(infos), 1)
+
+	// the fallback for filesystems without an atomic rename that doesn't replace
+	var moved, other = path.Join(tmpDir, "moved"), path.Join(tmpDir, "other")
+	is.NoErr(renameNoReplaceLink(OSFS, target, moved))
+	is.NoErr(os.Mkdir(target, 0777))
+	is.True(os.IsExist(renameNoReplaceLink(OSFS, target, moved)))
+	is.NoErr(PopulateTaggedStruct(moved, &check))
+	is.Equal(check, S{3, 4})
+	is.NoErr(WriteFile(other, []byte("other")))
+	is.True(os.IsExist(renameNoReplaceLink(OSFS, other, path.Join(moved, "a"))))
+	is.NoErr(renameNoReplaceLink(OSFS, other, path.Join(target, "a")))
+	_, err = os.Stat(other)
+	is.True(os.IsNotExist(err))
+}
+
+func TestMemFS(t *testing.T) {
+	var is = is.New(t)
+	var fs = NewMemFS()
+	is.NoErr(fs.MkdirAll("/data/a", 0777))
+	is.NoErr(WriteTaggedStructFiles("/data/a", original, WithFS(fs)))
+	var check S
+	is.NoErr(PopulateTaggedStruct("/data/a", &check, WithFS(fs)))
+	is.Equal(check, original)
+	var exists bool
+	var err error
+	exists, err = Exists("/data/a/a", WithFS(fs))
+	is.NoErr(err)
+	is.True(exists)
+	exists, err = Exists("/data/a/c", WithFS(fs))
+	is.NoErr(err)
+	is.True(!exists)
+
+	var f *File
+	f, err = CreateFileTmp("/data/a/b", WithFS(fs))
+	is.NoErr(err)
+	defer f.RemoveIfTmp()
+	_, err = f.Write([]byte("new"))
+	is.NoErr(err)
+	err = f.FinalizeNoReplace()
+	is.True(os.IsExist(err))
+	var old *File
+	old, err = f.FinalizeExchange()
+	is.NoErr(err)
+	is.NoErr(old.Remove())
+	var content []byte
+	content, err = ReadFile("/data/a/b", WithFS(fs))
+	is.NoErr(err)
+	is.Equal(string(content), "new")
+
+	is.NoErr(fs.Symlink("a/b", "/data/link"))
+	is.NoErr(CopyDir("/data", "/copy", WithFS(fs)))
+	content, err = ReadFile("/copy/link", WithFS(fs))
+	is.NoErr(err)
+	is.Equal(string(content), "new")
+	_, err = Move("/copy/a/a", "/copy/moved", WithFS(fs))
+	is.NoErr(err)
+	var infos []os.FileInfo
+	infos, err = fs.ReadDir("/copy")
+	is.NoErr(err)
+	is.Equal(len(infos), 3)
+	is.Equal(infos[1].Name(), "link")
+	is.NoErr(fs.RemoveAll("/copy"))
+	exists, err = Exists("/copy", WithFS(fs))
+	is.NoErr(err)
+	is.True(!exists)
+}
+
+func TestCrashTest(t *testing.T) {
+	var is = is.New(t)
+	var setup = func(fs FS) error {
+		return WriteFile("/file", []byte("old"), WithFS(fs))
+	}
+	var check = ExpectContent("/file", []byte("old"), []byte("new"))
+	is.NoErr(CrashTest(setup, func(fs FS) error {
+		return WriteFile("/file", []byte("new"), WithFS(fs))
+	}, check))
+	// writing in place is not atomic
+	var err = CrashTest(setup, func(fs FS) error {
+		var f, err = OpenFile("/file", WithFS(fs))
+		if err != nil {
+			return err
+		}
+		_, err = f.Write([]byte("n"))
+		if err == nil {
+			err = f.Sync()
+		}
+		if err == nil {
+			_, err = f.Write([]byte("ew"))
+		}
+		return appendError(err, f.Close())
+	}, check)
+	is.True(err != nil)
+}
+
+func TestFaultFS(t *testing.T) {
+	var is = is.New(t)
+	var mem = NewMemFS()
+	is.NoErr(WriteFile("/file", []byte("old"), WithFS(mem)))
+	var fs = NewFaultFS(mem)
+	fs.Inject(func(op FaultOp) *Fault {
+		if op.Name == "write" {
+			return &Fault{Err: syscall.ENOSPC, Short: true}
+		}
+		return nil
+	})
+	var err = WriteFile("/file", []byte("new"), WithFS(fs))
+	is.True(err != nil && strings.Contains(err.Error(), syscall.ENOSPC.Error()))
+	is.NoErr(ExpectContent("/file", []byte("old"))(mem))
+	var infos []os.FileInfo
+	infos, err = mem.ReadDir("/")
+	is.NoErr(err)
+	is.Equal(len(infos), 1)
+
+	// Close doesn't leave the temporary file behind if it can't be finalized
+	fs.Inject(func(op FaultOp) *Fault {
+		if op.Name == "rename" {
+			return &Fault{Err: syscall.EIO}
+		}
+		return nil
+	})
+	var f *File
+	f, err = CreateFileTmp("/file", WithFS(fs))
+	is.NoErr(err)
+	_, err = f.Write([]byte("new"))
+	is.NoErr(err)
+	err = f.Close()
+	is.True(err != nil && strings.Contains(err.Error(), syscall.EIO.Error()))
+	is.NoErr(ExpectContent("/file", []byte("old"))(mem))
+	infos, err = mem.ReadDir("/")
+	is.NoErr(err)
+	is.Equal(len(infos), 1)
+
+	fs.InjectAt(len(fs.Ops()), Fault{Crash: true})
+	err = WriteFile("/file", []byte("new"), WithFS(fs))
+	is.True(err != nil && strings.Contains(err.Error(), ErrCrashed.Error()))
+	is.True(fs.Crashed())
+}
+
+func TestReadFS(t *testing.T) {
+	var is = is.New(t)
+	var buf bytes.Buffer
+	is.NoErr(WriteBinary(&buf, original.B))
+	var fsys = fstest.MapFS{
+		"data/a":       {Data: []byte("1\n")},
+		"data/b":       {Data: buf.Bytes()},
+		"data/file.0":  {Data: []byte("content")},
+		"data/file.1":  {},
+		"data/other.2": {},
+	}
+	var check S
+	is.NoErr(PopulateTaggedStructFS(fsys, "data", &check))
+	is.Equal(check, original)
+	var content []byte
+	var err error
+	content, err = ReadFileFS(fsys, "data/file.0")
+	is.NoErr(err)
+	is.Equal(string(content), "content")
+	var numbers []uint64
+	numbers, _, err = FindNumberedFilesFS(fsys, "data", "file.", "")
+	is.NoErr(err)
+	is.Equal(numbers, []uint64{0, 1})
+}
+
+func TestLeakDiagnostics(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var leaks = make(chan Leak, 1)
+	SetLeakDebug(true)
+	defer SetLeakDebug(false)
+	defer SetLeakHandler(SetLeakHandler(func(leak Leak) {
+		// files leaked by other tests are ignored
+		if strings.HasPrefix(leak.Path, tmpDir) {
+			leaks <- leak
+		}
+	}))
+
+	func() {
+		var _, err = CreateFileTmp(path.Join(tmpDir, "file"), NamedTmp(), OnLeak(LeakRemove))
+		is.NoErr(err)
+	}()
+	var leak Leak
+	var deadline = time.Now().Add(10 * time.Second)
+	for leak.Type == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("leaked file was not reported")
+		}
+		runtime.GC()
+		select {
+		case leak = <-leaks:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	is.Equal(leak.Type, "File")
+	is.True(leak.Tmp)
+	is.NoErr(leak.Err)
+	is.True(strings.Contains(leak.Stack, "TestLeakDiagnostics"))
+	var infos []os.FileInfo
+	infos, err = ioutil.ReadDir(tmpDir)
+	is.NoErr(err)
+	is.Equal(len(infos), 0)
+}
+
+func TestObserver(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var target = path.Join(tmpDir, "file")
+
+	var kinds []EventKind
+	var written int64
+	var observer = ObserverFunc(func(event Event) {
+		is.NoErr(event.Err)
+		kinds = append(kinds, event.Kind)
+		if event.Kind == EventWrite {
+			written += event.Bytes
+		}
+	})
+	is.NoErr(WriteFile(target, []byte("content"), WithObserver(observer)))
+	is.Equal(kinds[0], EventOpen)
+	is.Equal(kinds[len(kinds)-1], EventSync)
+	is.Equal(written, int64(7))
+	var renamed bool
+	for _, kind := range kinds {
+		renamed = renamed || kind == EventRename
+	}
+	is.True(renamed)
+
+	// expvar names can't be unpublished, so every run of the test needs its own
+	var name = fmt.Sprintf("fileutils_test_%d", time.Now().UnixNano())
+	var expvarObserver *ExpvarObserver
+	expvarObserver, err = NewExpvarObserver(name)
+	is.NoErr(err)
+	is.NoErr(WriteFile(target, []byte("content"), WithObserver(expvarObserver)))
+	var metrics map[string]struct {
+		Count   int
+		Bytes   int64
+		Latency map[string]int
+	}
+	is.NoErr(json.Unmarshal([]byte(expvar.Get(name).String()), &metrics))
+	is.Equal(metrics["rename"].Count, 1)
+	is.Equal(metrics["write"].Bytes, int64(7))
+	var total int
+	for _, count := range metrics["sync"].Latency {
+		total += count
+	}
+	is.Equal(total, metrics["sync"].Count)
+
+	// observers with the same name share the metrics
+	expvarObserver, err = NewExpvarObserver(name)
+	is.NoErr(err)
+	is.NoErr(WriteFile(target, []byte("content"), WithObserver(expvarObserver)))
+	is.NoErr(json.Unmarshal([]byte(expvar.Get(name).String()), &metrics))
+	is.Equal(metrics["rename"].Count, 2)
+
+	expvar.NewInt(name + "_int")
+	_, err = NewExpvarObserver(name + "_int")
+	is.True(err != nil)
+}
+
+func TestDurability(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var target = path.Join(tmpDir, "file")
+
+	for _, d := range []Durability{DurabilityNone, DurabilityData, DurabilityFull} {
+		var fileSyncs, dirSyncs int
+		var observer = ObserverFunc(func(event Event) {
+			if event.Kind == EventSync && event.Path == tmpDir {
+				dirSyncs++
+			} else if event.Kind == EventSync {
+				fileSyncs++
+			}
+		})
+		is.NoErr(WriteFile(target, []byte("content"), WithDurability(d), WithObserver(observer)))
+		is.Equal(fileSyncs > 0, d >= DurabilityData)
+		is.Equal(dirSyncs > 0, d >= DurabilityFull)
+
+		fileSyncs, dirSyncs = 0, 0
+		var f *File
+		f, err = OpenFile(target, WithDurability(d), WithObserver(observer))
+		is.NoErr(err)
+		_, err = f.Write([]byte("more"))
+		is.NoErr(err)
+		is.NoErr(f.Close())
+		is.Equal(fileSyncs > 0, d >= DurabilityData)
+		is.Equal(dirSyncs, 0)
+
+		fileSyncs, dirSyncs = 0, 0
+		is.NoErr(Copy(target, target+".copy", PreserveTimes(), WithDurability(d), WithObserver(observer)))
+		is.Equal(fileSyncs > 0, d >= DurabilityData)
+		is.Equal(dirSyncs > 0, d >= DurabilityFull)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var auto = Compress(CompressionAuto)
+
+	var gz = path.Join(tmpDir, "value.json.gz")
+	is.NoErr(WriteJsonFileValues(gz, []interface{}{original}, auto))
+	var raw []byte
+	raw, err = ReadFile(gz, Compress(CompressionNone))
+	is.NoErr(err)
+	is.True(bytes.HasPrefix(raw, []byte{0x1f, 0x8b}))
+	var check S
+	is.NoErr(ReadJsonFile(gz, &check, auto))
+	is.Equal(check, original)
+
+	// compressed and uncompressed files are read alike without options
+	var plain = path.Join(tmpDir, "value.json")
+	is.NoErr(WriteJsonFile(plain, original))
+	for _, name := range []string{plain, gz} {
+		check = S{}
+		is.NoErr(ReadJsonFile(name, &check))
+		is.Equal(check, original)
+	}
+
+	// gzip is detected without extension
+	var gzPlain = path.Join(tmpDir, "gzip.json")
+	is.NoErr(WriteJsonFileValues(gzPlain, []interface{}{original}, Compress(CompressionGzip)))
+	check = S{}
+	is.NoErr(ReadJsonFile(gzPlain, &check, auto))
+	is.Equal(check, original)
+	var content []byte
+	content, err = ReadFile(gzPlain, Compress(CompressionNone))
+	is.NoErr(err)
+	is.True(bytes.HasPrefix(content, []byte{0x1f, 0x8b}))
+
+	// without options, the bytes are written as they are
+	var rawGz = path.Join(tmpDir, "raw.gz")
+	is.NoErr(WriteFile(rawGz, []byte("not compressed")))
+	content, err = ReadFile(rawGz)
+	is.NoErr(err)
+	is.Equal(string(content), "not compressed")
+
+	var zz = path.Join(tmpDir, "values.zz")
+	var values = []int64{1, 2, 3}
+	is.NoErr(WriteBinaryFile(zz, values, auto))
+	var checkValues []int64
+	is.NoErr(ReadBinaryFile(zz, &checkValues, auto))
+	is.Equal(checkValues, values)
+
+	var f *File
+	f, err = CreateFileTmp(gz, auto)
+	is.NoErr(err)
+	defer f.RemoveIfTmp()
+	_, err = f.Seek(0, io.SeekStart)
+	is.Equal(errors.Cause(err), ErrCompressed)
+
+	_, err = CreateFile(gz, auto)
+	is.Equal(errors.Cause(err), ErrCompressed)
+
+	// Finalize completes the compressed stream
+	var finalized = path.Join(tmpDir, "finalized")
+	f, err = CreateFileTmp(finalized, Compress(CompressionZlib))
+	is.NoErr(err)
+	defer f.Close()
+	_, err = f.Write([]byte("content"))
+	is.NoErr(err)
+	is.NoErr(f.Finalize())
+	content, err = ReadFile(finalized, Compress(CompressionZlib))
+	is.NoErr(err)
+	is.Equal(string(content), "content")
+	// zlib is detected as well
+	content, err = ReadFile(finalized)
+	is.NoErr(err)
+	is.Equal(string(content), "content")
+
+	var copied = path.Join(tmpDir, "copy.json.gz")
+	is.NoErr(Copy(gz, copied))
+	content, err = ReadFile(copied, Compress(CompressionNone))
+	is.NoErr(err)
+	is.Equal(content, raw)
+	var compressed = path.Join(tmpDir, "copy.json")
+	is.NoErr(Copy(rawGz, compressed, Compress(CompressionGzip)))
+	content, err = ReadFile(compressed, Compress(CompressionGzip))
+	is.NoErr(err)
+	is.Equal(string(content), "not compressed")
+}
+
+func TestEncryption(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var keys = StaticKey("k1", bytes.Repeat([]byte{7}, 32))
+
+	var jsonPath = path.Join(tmpDir, "value.json.gz")
+	is.NoErr(WriteJsonFileValues(jsonPath, []interface{}{original}, Encrypt(keys)))
+	var check S
+	is.NoErr(ReadJsonFile(jsonPath, &check, Encrypt(keys)))
+	is.Equal(check, original)
+	// without keys, the file is read as it is
+	var raw []byte
+	raw, err = ReadFile(jsonPath)
+	is.NoErr(err)
+	is.True(bytes.HasPrefix(raw, []byte(encryptionMagic)))
+	_, err = ReadFile(jsonPath, Encrypt(StaticKey("k2", bytes.Repeat([]byte{7}, 32))))
+	is.True(err != nil)
+
+	// multiple chunks, with the last one being full
+	var binPath = path.Join(tmpDir, "values")
+	var values = make([]int64, 2*encryptionChunkSize/8)
+	for i := range values {
+		values[i] = int64(i)
+	}
+	is.NoErr(WriteBinaryFile(binPath, values, Encrypt(keys)))
+	var checkValues []int64
+	is.NoErr(ReadBinaryFile(binPath, &checkValues, Encrypt(keys)))
+	is.Equal(checkValues, values)
+
+	raw, err = ioutil.ReadFile(binPath)
+	is.NoErr(err)
+	var broken = path.Join(tmpDir, "broken")
+	var sealedChunk = encryptionChunkSize + 16
+	for _, content := range [][]byte{
+		raw[:len(raw)-sealedChunk], // last chunk removed
+		raw[:len(raw)-1],           // last chunk truncated
+		append(append([]byte{}, raw[:len(raw)-10]...), raw[len(raw)-10]^1), // tampered
+	} {
+		is.NoErr(ioutil.WriteFile(broken, content, 0666))
+		_, err = ReadFile(broken, Encrypt(keys))
+		is.Equal(errors.Cause(err), ErrDecryption)
+	}
+	is.NoErr(ioutil.WriteFile(broken, []byte("plain"), 0666))
+	_, err = ReadFile(broken, Encrypt(keys))
+	is.Equal(errors.Cause(err), ErrDecryption)
+
+	var f *File
+	f, err = CreateFileTmp(binPath, Encrypt(keys))
+	is.NoErr(err)
+	defer f.RemoveIfTmp()
+	_, err = f.ReadAt(make([]byte, 1), 0)
+	is.Equal(errors.Cause(err), ErrEncrypted)
+}
+
+func TestChecksum(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var values = []int64{1, 2, 3, 4}
+
+	for _, placement := range []ChecksumPlacement{ChecksumTrailer, ChecksumSidecar} {
+		for _, algorithm := range []ChecksumAlgorithm{ChecksumCRC32C, ChecksumSHA256} {
+			var opt = WithChecksum(algorithm, placement)
+			var binPath = path.Join(tmpDir, fmt.Sprintf("values%d%d", placement, algorithm))
+			is.NoErr(WriteBinaryFile(binPath, values, opt))
+			is.NoErr(Verify(binPath, opt))
+			var check []int64
+			is.NoErr(ReadBinaryFile(binPath, &check, opt))
+			is.Equal(check, values)
+
+			var raw []byte
+			raw, err = ioutil.ReadFile(binPath)
+			is.NoErr(err)
+			raw[3] ^= 1
+			is.NoErr(ioutil.WriteFile(binPath, raw, 0666))
+			err = ReadBinaryFile(binPath, &check, opt)
+			var corruption, ok = errors.Cause(err).(*CorruptionError)
+			is.True(ok)
+			is.Equal(corruption.Algorithm, algorithm)
+		}
+	}
+
+	// the sidecar can be checked with sha256sum
+	var jsonPath = path.Join(tmpDir, "value.json.gz")
+	is.NoErr(WriteJsonFileValues(jsonPath, []interface{}{original}, WithChecksum(ChecksumSHA256, ChecksumSidecar)))
+	var content, sidecar []byte
+	content, err = ioutil.ReadFile(jsonPath)
+	is.NoErr(err)
+	sidecar, err = ioutil.ReadFile(jsonPath + ".sha256")
+	is.NoErr(err)
+	is.Equal(string(sidecar), fmt.Sprintf("%x  value.json.gz\n", sha256.Sum256(content)))
+	var check S
+	is.NoErr(ReadJsonFile(jsonPath, &check, WithChecksum(ChecksumSHA256, ChecksumSidecar)))
+	is.Equal(check, original)
+
+	// the checksum is recomputed after positional writes
+	var f *File
+	f, err = CreateFileTmp(path.Join(tmpDir, "positional"), WithChecksum(ChecksumCRC32C, ChecksumTrailer))
+	is.NoErr(err)
+	_, err = f.Write([]byte("abcd"))
+	is.NoErr(err)
+	_, err = f.WriteAt([]byte("x"), 1)
+	is.NoErr(err)
+	is.NoErr(f.Close())
+	content, err = ReadFile(f.Path(), WithChecksum(ChecksumCRC32C, ChecksumTrailer))
+	is.NoErr(err)
+	is.Equal(string(content), "axcd")
+
+	is.NoErr(ioutil.WriteFile(f.Path(), []byte("abcd"), 0666))
+	err = Verify(f.Path(), WithChecksum(ChecksumCRC32C, ChecksumTrailer))
+	var _, ok = errors.Cause(err).(*CorruptionError)
+	is.True(ok)
+}
+
+func TestSpace(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+
+	for _, fs := range []FS{OSFS, NewMemFS()} {
+		is.NoErr(mkdirAll(fs, tmpDir, 0777))
+		var f *File
+		f, err = CreateFile(path.Join(tmpDir, "space"), WithFS(fs))
+		is.NoErr(err)
+		is.NoErr(f.Preallocate(0, 1<<20))
+		var size int64
+		size, err = f.Size()
+		is.NoErr(err)
+		is.Equal(size, int64(1<<20))
+
+		var data = bytes.Repeat([]byte{1}, 1<<20)
+		_, err = f.WriteAt(data, 0)
+		is.NoErr(err)
+		is.NoErr(f.PunchHole(256<<10, 256<<10))
+		is.NoErr(f.ZeroRange(768<<10, 128<<10))
+		is.NoErr(f.PunchHole(1<<20, 4096))
+		size, err = f.Size()
+		is.NoErr(err)
+		is.Equal(size, int64(1<<20))
+		var content = make([]byte, 1<<20)
+		_, err = f.ReadAt(content, 0)
+		is.NoErr(err)
+		for i := range data[256<<10 : 512<<10] {
+			data[256<<10+i] = 0
+		}
+		for i := range data[768<<10 : 896<<10] {
+			data[768<<10+i] = 0
+		}
+		is.True(bytes.Equal(content, data))
+
+		// the regions contain all data and don't overlap
+		var covered = make([]byte, 1<<20)
+		var end int64
+		var it = f.DataRegions()
+		for it.Next() {
+			var region = it.Region()
+			is.True(region.Offset >= end && region.Length > 0)
+			end = region.Offset + region.Length
+			copy(covered[region.Offset:end], content[region.Offset:end])
+		}
+		is.NoErr(it.Err())
+		is.True(bytes.Equal(covered, data))
+		_, err = f.SeekData(1 << 20)
+		is.Equal(err, io.EOF)
+		var hole int64
+		hole, err = f.SeekHole(0)
+		is.NoErr(err)
+		is.True(hole >= 256<<10)
+		is.NoErr(f.Close())
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+
+	var usage Usage
+	usage, err = DiskUsage(tmpDir)
+	is.NoErr(err)
+	is.True(usage.Total > 0 && usage.Available <= usage.Free && usage.Free <= usage.Total)
+
+	var binPath = path.Join(tmpDir, "values")
+	var values = []int64{1, 2, 3}
+	var tooMuch = CheckFreeSpace(int64(usage.Total))
+	err = WriteBinaryFile(binPath, values, tooMuch)
+	is.Equal(errors.Cause(err), ErrInsufficientSpace)
+	_, err = CreateFileTmp(binPath, CheckFreeSpace(0), ExpectedSize(int64(usage.Total)))
+	is.Equal(errors.Cause(err), ErrInsufficientSpace)
+	var infos []os.FileInfo
+	infos, err = ioutil.ReadDir(tmpDir)
+	is.NoErr(err)
+	is.Equal(len(infos), 0)
+
+	is.NoErr(WriteBinaryFile(binPath, values, CheckFreeSpace(4096)))
+	// filesystems without DiskUsageFS are not checked
+	var mem = NewMemFS()
+	is.NoErr(mkdirAll(mem, tmpDir, 0777))
+	is.NoErr(WriteBinaryFile(binPath, values, tooMuch, WithFS(mem)))
+}
+
+// countdownContext is canceled after its Err method was called n times.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (ctx *countdownContext) Err() error {
+	if ctx.n <= 0 {
+		return context.Canceled
+	}
+	ctx.n--
+	return nil
+}
+
+func TestContext(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var isEmpty = func(dir string) {
+		var infos, err = ioutil.ReadDir(dir)
+		is.NoErr(err)
+		is.Equal(len(infos), 0)
+	}
+
+	var binPath = path.Join(tmpDir, "values")
+	var values = make([]byte, 3*contextChunkSize)
+	err = WriteBinaryFileContext(&countdownContext{context.Background(), 2}, binPath, values)
+	is.Equal(errors.Cause(err), context.Canceled)
+	is.True(strings.Contains(err.Error(), binPath))
+	isEmpty(tmpDir)
+	is.NoErr(WriteBinaryFileContext(context.Background(), binPath, values))
+
+	var canceledCtx, cancel = context.WithCancel(context.Background())
+	cancel()
+	var copied = path.Join(tmpDir, "copy")
+	err = CopyContext(canceledCtx, binPath, copied)
+	is.Equal(errors.Cause(err), context.Canceled)
+	var mem = NewMemFS()
+	is.NoErr(mem.MkdirAll(tmpDir, 0777))
+	is.NoErr(WriteFile(binPath, values, WithFS(mem)))
+	err = CopyContext(&countdownContext{context.Background(), 2}, binPath, copied, WithFS(mem))
+	is.Equal(errors.Cause(err), context.Canceled)
+	var memInfos []os.FileInfo
+	memInfos, err = mem.ReadDir(tmpDir)
+	is.NoErr(err)
+	is.Equal(len(memInfos), 1)
+	err = CopyContext(&countdownContext{context.Background(), 2}, binPath, copied, NamedTmp())
+	is.Equal(errors.Cause(err), context.Canceled)
+	var infos []os.FileInfo
+	infos, err = ioutil.ReadDir(tmpDir)
+	is.NoErr(err)
+	is.Equal(len(infos), 1)
+	is.NoErr(CopyContext(context.Background(), binPath, copied))
+
+	var jsonPath = path.Join(tmpDir, "values.json")
+	is.NoErr(WriteJsonFile(jsonPath, 1, 2, 3))
+	var ints []int
+	err = ReadJsonFileAppendContext(canceledCtx, jsonPath, &ints)
+	is.Equal(errors.Cause(err), context.Canceled)
+	is.Equal(len(ints), 0)
+
+	// the first file is extracted and the partial second file is removed
+	var archive bytes.Buffer
+	var tw = NewTarWriter(&archive)
+	is.NoErr(tw.AddFileBytes("small", []byte("small")))
+	is.NoErr(tw.AddFileBytes("large", values))
+	is.NoErr(tw.Close())
+	var untarDir = path.Join(tmpDir, "untar")
+	err = UntarContext(&countdownContext{context.Background(), 5}, untarDir, bytes.NewReader(archive.Bytes()))
+	is.Equal(errors.Cause(err), context.Canceled)
+	infos, err = ioutil.ReadDir(untarDir)
+	is.NoErr(err)
+	is.Equal(len(infos), 1)
+	is.Equal(infos[0].Name(), "small")
+
+	tw = NewTarWriter(ioutil.Discard)
+	err = tw.AddPathContext(canceledCtx, "", tmpDir)
+	is.Equal(errors.Cause(err), context.Canceled)
+}
+
+func TestProgress(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+	var reports []Progress
+	var record = WithProgress(func(progress Progress) {
+		reports = append(reports, progress)
+	}, 0)
+	var checkReports = func(total int64, minReports int) {
+		is.True(len(reports) >= minReports)
+		var last = reports[len(reports)-1]
+		is.Equal(last.Done, last.Total)
+		is.Equal(last.Total, total)
+		for i := 1; i < len(reports); i++ {
+			is.True(reports[i].Done >= reports[i-1].Done)
+		}
+		reports = nil
+	}
+
+	var srcDir = path.Join(tmpDir, "src")
+	is.NoErr(os.Mkdir(srcDir, 0777))
+	var binPath = path.Join(srcDir, "values")
+	var values = make([]byte, 3*contextChunkSize+1)
+	is.NoErr(WriteBinaryFile(binPath, values, record))
+	checkReports(int64(len(values)), 2)
+
+	// a reflink copies everything at once, so only the completion may be reported
+	is.NoErr(Copy(binPath, path.Join(srcDir, "copy"), record))
+	checkReports(int64(len(values)), 1)
+
+	var archive bytes.Buffer
+	var tw = NewTarWriter(&archive)
+	is.NoErr(tw.AddPath("", srcDir, record))
+	checkReports(2*int64(len(values)), 2)
+	is.NoErr(tw.Close())
+
+	var untarDir = path.Join(tmpDir, "untar")
+	is.NoErr(Untar(untarDir, &archive, record))
+	var last = reports[len(reports)-1]
+	is.Equal(last.Done, 2*int64(len(values)))
+	is.Equal(last.Total, int64(-1))
+	is.True(strings.HasPrefix(last.Path, untarDir))
+
+	// reports are throttled
+	reports = nil
+	is.NoErr(WriteBinaryFile(binPath, values, WithProgress(func(progress Progress) {
+		reports = append(reports, progress)
+	}, time.Hour)))
+	is.Equal(len(reports), 2)
+}
@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package fileutils
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openTmpfile creates an unnamed file in dir using O_TMPFILE.
+func openTmpfile(dir string, perm os.FileMode) (*os.File, error) {
+	var fd, err = unix.Open(dir, unix.O_RDWR|unix.O_TMPFILE|unix.O_CLOEXEC, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	return os.NewFile(uintptr(fd), dir), nil
+}
+
+// linkTmpfile gives a file created by openTmpfile a name. It fails if path exists.
+func linkTmpfile(file *os.File, path string) error {
+	var fd = int(file.Fd())
+	var err = unix.Linkat(fd, "", unix.AT_FDCWD, path, unix.AT_EMPTY_PATH)
+	if err == unix.ENOENT || err == unix.EPERM {
+		// AT_EMPTY_PATH requires CAP_DAC_READ_SEARCH, linking the /proc entry does not
+		err = unix.Linkat(unix.AT_FDCWD, procFdPath(file), unix.AT_FDCWD, path, unix.AT_SYMLINK_FOLLOW)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "linkat", Old: file.Name(), New: path, Err: err}
+	}
+	return nil
+}
+
+// procFdPath returns a path that refers to the open file, even if it has no name.
+func procFdPath(file *os.File) string {
+	return fmt.Sprintf("/proc/self/fd/%d", file.Fd())
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package fileutils
+
+import (
+	"os"
+
+	"github.com/infobaleen/errors"
+)
+
+func openTmpfile(dir string, perm os.FileMode) (*os.File, error) {
+	return nil, errors.Fmt("O_TMPFILE is not supported on this platform")
+}
+
+func linkTmpfile(file *os.File, path string) error {
+	return errors.Fmt("O_TMPFILE is not supported on this platform")
+}
+
+func procFdPath(file *os.File) string {
+	return file.Name()
+}
@@ -0,0 +1,271 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd || solaris
+// +build linux darwin dragonfly freebsd netbsd openbsd solaris
+
+package fileutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/infobaleen/errors"
+)
+
+const (
+	transactionCurrent = "current"
+	transactionLock    = ".lock"
+	generationPrefix   = "gen"
+)
+
+// Transaction changes several files in a dataset directory, so that readers see either all or none of the changes.
+// Each committed state is a generation directory "<root>/gen<number>" and the symbolic link "<root>/current" points to
+// the latest one. Readers must resolve it once with CurrentGeneration and read all files from the returned directory.
+// A new generation starts with hard links to the files of the current one, which must not be modified in place,
+// but replaced using Create or the Write*File functions.
+// Only one transaction per root can be active at a time, which is ensured across processes with LockFile.
+type Transaction struct {
+	mutex sync.Mutex
+	root  string
+	opts  []Option
+	lock  *FileLock
+	dir   *Dir
+	gen   uint64
+	files []*File
+}
+
+// BeginTransaction starts a transaction on the dataset directory root, which is created if necessary.
+// It waits until other transactions are finished and rolls back transactions that were interrupted by a crash.
+// Transactions rely on locks and symlinks of the operating system, so the options must not select another FS than OSFS.
+func BeginTransaction(root string, opts ...Option) (*Transaction, error) {
+	if newOptions(opts).fs != OSFS {
+		return nil, errors.Fmt("transactions are only supported by OSFS")
+	}
+	var err error
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(root, 0777)
+	if err != nil {
+		return nil, err
+	}
+	var tx = &Transaction{root: root, opts: opts}
+	tx.lock, err = LockFile(filepath.Join(root, transactionLock), -1)
+	if err != nil {
+		return nil, err
+	}
+	var current uint64
+	current, err = recoverTransactions(root)
+	if err != nil {
+		return nil, errors.WithAftermath(err, tx.lock.Unlock())
+	}
+	tx.gen = current + 1
+	tx.dir, err = CreateDirTmp(filepath.Join(root, generationPrefix+strconv.FormatUint(tx.gen, 10)), opts...)
+	if err == nil && current > 0 {
+		err = linkTree(filepath.Join(root, generationPrefix+strconv.FormatUint(current, 10)), tx.dir.Path())
+	}
+	if err != nil {
+		if tx.dir != nil {
+			err = errors.WithAftermath(err, tx.dir.RemoveIfTmp())
+		}
+		return nil, errors.WithAftermath(err, tx.lock.Unlock())
+	}
+	return tx, nil
+}
+
+// Path returns the directory of the new generation. Files can be written to it directly, e.g. with WriteJsonFile.
+func (tx *Transaction) Path() string {
+	return tx.dir.Path()
+}
+
+// Create creates a file in the new generation. It is finalized at the latest when the transaction is committed.
+func (tx *Transaction) Create(name string, opts ...Option) (*File, error) {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	if tx.lock == nil {
+		return nil, errors.Fmt("transaction is finished")
+	}
+	var f, err = CreateFileTmp(filepath.Join(tx.dir.Path(), name), append(tx.opts[:len(tx.opts):len(tx.opts)], opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	tx.files = append(tx.files, f)
+	return f, nil
+}
+
+// Remove removes a file from the new generation.
+func (tx *Transaction) Remove(name string) error {
+	return os.Remove(filepath.Join(tx.Path(), name))
+}
+
+// Commit makes the new generation the current one and removes all generations except the previous one,
+// which readers might still be using.
+func (tx *Transaction) Commit() error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	if tx.lock == nil {
+		return errors.Fmt("transaction is finished")
+	}
+	for _, f := range tx.files {
+		if !f.isClosed() {
+			if err := f.Close(); err != nil {
+				return tx.rollback(err)
+			}
+		}
+	}
+	tx.files = nil
+	var err = tx.dir.FinalizeNoReplace()
+	if err != nil {
+		return tx.rollback(err)
+	}
+	var currentPath = filepath.Join(tx.root, transactionCurrent)
+	err = replaceSymlink(filepath.Base(tx.dir.Path()), currentPath, tx.dir.durability)
+	if err != nil {
+		return tx.rollback(errors.WithAftermath(err, os.RemoveAll(tx.dir.Path())))
+	}
+	err = removeGenerations(tx.root, func(gen uint64) bool { return gen+1 < tx.gen })
+	return appendError(err, tx.unlock())
+}
+
+// Rollback discards the new generation. It does nothing if the transaction was already committed or rolled back,
+// so it can be deferred right after BeginTransaction.
+func (tx *Transaction) Rollback() error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	if tx.lock == nil {
+		return nil
+	}
+	return tx.rollback(nil)
+}
+
+func (tx *Transaction) rollback(err error) error {
+	for _, f := range tx.files {
+		err = appendError(err, f.RemoveIfTmp())
+	}
+	tx.files = nil
+	err = appendError(err, tx.dir.RemoveIfTmp())
+	return appendError(err, tx.unlock())
+}
+
+func (tx *Transaction) unlock() error {
+	var err = tx.lock.Unlock()
+	tx.lock = nil
+	return err
+}
+
+// CurrentGeneration returns the directory of the latest committed generation of a dataset written with transactions.
+// If there is none, the cause of the returned error is os.ErrNotExist (see github.com/pkg/errors).
+func CurrentGeneration(root string) (string, error) {
+	var target, err = os.Readlink(filepath.Join(root, transactionCurrent))
+	if os.IsNotExist(err) {
+		return "", errors.Wrap(os.ErrNotExist, "no generation committed in %q", root)
+	} else if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, target), nil
+}
+
+// RecoverTransactions rolls back transactions on root that were interrupted by a crash.
+// It is called by BeginTransaction, but can be used to reclaim space earlier.
+func RecoverTransactions(root string) error {
+	var lock, err = LockFile(filepath.Join(root, transactionLock), -1)
+	if err != nil {
+		return err
+	}
+	_, err = recoverTransactions(root)
+	return appendError(err, lock.Unlock())
+}
+
+// recoverTransactions removes everything that doesn't belong to a committed generation and returns the current one.
+func recoverTransactions(root string) (uint64, error) {
+	var current uint64
+	var currentPath, err = CurrentGeneration(root)
+	if err == nil {
+		var ok bool
+		current, ok = IsNumberedName(filepath.Base(currentPath), generationPrefix, "")
+		if !ok {
+			return 0, errors.Fmt("%q doesn't point to a generation", filepath.Join(root, transactionCurrent))
+		}
+	} else if errors.Cause(err) != os.ErrNotExist {
+		return 0, err
+	}
+
+	var infos []os.FileInfo
+	infos, err = ioutil.ReadDir(root)
+	if err != nil {
+		return 0, err
+	}
+	for _, info := range infos {
+		if IsTmpName(info.Name()) {
+			err = os.RemoveAll(filepath.Join(root, info.Name()))
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	// generations that were finalized but never became current
+	return current, removeGenerations(root, func(gen uint64) bool { return gen > current })
+}
+
+func removeGenerations(root string, filter func(gen uint64) bool) error {
+	var gens, names, err = FindNumberedFiles(root, generationPrefix, "")
+	if err != nil {
+		return err
+	}
+	for i, gen := range gens {
+		if filter(gen) {
+			err = os.RemoveAll(filepath.Join(root, names[i]))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replaceSymlink atomically replaces the symbolic link at path.
+func replaceSymlink(target, path string, durability Durability) error {
+	var err = os.ErrExist
+	var name string
+	for i := 0; i < 100 && os.IsExist(err); i++ {
+		name = tmpName(filepath.Dir(path), defaultTmpPattern, path)
+		err = os.Symlink(target, name)
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(name, path)
+	if err != nil {
+		return errors.WithAftermath(err, os.Remove(name))
+	}
+	if durability >= DurabilityFull {
+		return syncDir(OSFS, filepath.Dir(path))
+	}
+	return nil
+}
+
+// linkTree creates hard links in dst to all regular files in the directory tree src.
+func linkTree(src, dst string) error {
+	var infos, err = ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		var srcPath = filepath.Join(src, info.Name())
+		var dstPath = filepath.Join(dst, info.Name())
+		if info.IsDir() {
+			err = os.Mkdir(dstPath, info.Mode().Perm())
+			if err == nil {
+				err = linkTree(srcPath, dstPath)
+			}
+		} else if info.Mode().IsRegular() {
+			err = os.Link(srcPath, dstPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
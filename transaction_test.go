@@ -0,0 +1,62 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd || solaris
+// +build linux darwin dragonfly freebsd netbsd openbsd solaris
+
+package fileutils
+
+import (
+	"github.com/matryer/is"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTransaction(t *testing.T) {
+	var is = is.New(t)
+	var tmpDir, err = ioutil.TempDir("", "")
+	is.NoErr(err)
+	defer os.RemoveAll(tmpDir)
+
+	for i := int64(1); i <= 3; i++ {
+		var tx *Transaction
+		tx, err = BeginTransaction(tmpDir)
+		is.NoErr(err)
+		is.NoErr(WriteJsonFile(path.Join(tx.Path(), "a"), i))
+		var f *File
+		f, err = tx.Create("b")
+		is.NoErr(err)
+		is.NoErr(WriteBinary(f, i))
+		is.NoErr(tx.Commit())
+		is.NoErr(tx.Rollback())
+	}
+
+	var interrupted, rolledBack *Transaction
+	interrupted, err = BeginTransaction(tmpDir)
+	is.NoErr(err)
+	is.NoErr(WriteTaggedStructFiles(interrupted.Path(), S{4, 4}))
+	is.NoErr(interrupted.unlock())
+	rolledBack, err = BeginTransaction(tmpDir)
+	is.NoErr(err)
+	is.NoErr(WriteTaggedStructFiles(rolledBack.Path(), S{5, 5}))
+	is.NoErr(rolledBack.Rollback())
+
+	var current string
+	current, err = CurrentGeneration(tmpDir)
+	is.NoErr(err)
+	is.Equal(current, path.Join(tmpDir, "gen3"))
+	var check S
+	is.NoErr(PopulateTaggedStruct(current, &check))
+	is.Equal(check, S{3, 3})
+	var gens []uint64
+	gens, _, err = FindNumberedFiles(tmpDir, "gen", "")
+	is.NoErr(err)
+	is.Equal(gens, []uint64{2, 3})
+	is.NoErr(RecoverTransactions(tmpDir))
+	var infos []os.FileInfo
+	infos, err = ioutil.ReadDir(tmpDir)
+	is.NoErr(err)
+	is.Equal(len(infos), 4)
+
+	_, err = BeginTransaction(tmpDir, WithFS(NewMemFS()))
+	is.True(err != nil)
+}
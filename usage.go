@@ -0,0 +1,72 @@
+package fileutils
+
+import (
+	"path/filepath"
+
+	"github.com/infobaleen/errors"
+)
+
+// ErrInsufficientSpace is the cause of errors returned when the free space checked with the CheckFreeSpace option is
+// not available.
+const ErrInsufficientSpace = constError("insufficient space")
+
+// Usage describes the space of a filesystem in bytes.
+type Usage struct {
+	Total uint64
+	Free  uint64
+	// Available is the free space that can be used by unprivileged users, which excludes reserved blocks.
+	Available uint64
+}
+
+// DiskUsageFS is implemented by filesystems that can report their space.
+type DiskUsageFS interface {
+	FS
+	// DiskUsage returns the space of the filesystem containing the path.
+	DiskUsage(name string) (Usage, error)
+}
+
+// DiskUsage returns the space of the filesystem containing the path.
+func DiskUsage(path string, opts ...Option) (Usage, error) {
+	var o = newOptions(opts)
+	if fs, ok := o.fs.(DiskUsageFS); ok {
+		return fs.DiskUsage(path)
+	}
+	return Usage{}, errors.Fmt("disk usage is not supported by the filesystem")
+}
+
+// CheckFreeSpace makes CreateFileTmp, MmapCreateSlices and WriteBinaryFile fail with ErrInsufficientSpace before
+// creating anything if less than the expected size plus margin bytes are available. MmapCreateSlices and WriteBinaryFile
+// know the expected size, for CreateFileTmp it is set with ExpectedSize. The check is skipped for filesystems that
+// don't implement DiskUsageFS, while it fails for OSFS on platforms where the space can't be determined. It can't
+// guarantee that the space is still available while the file is written, which Preallocate does.
+func CheckFreeSpace(margin int64) Option {
+	return func(o *options) {
+		o.checkSpace = true
+		o.spaceMargin = margin
+	}
+}
+
+// ExpectedSize sets the expected size of a created file for CheckFreeSpace.
+func ExpectedSize(size int64) Option {
+	return func(o *options) {
+		o.expectedSize = size
+	}
+}
+
+// checkFreeSpace checks the space for a file that is created in dir, if required by the options.
+func checkFreeSpace(o options, dir string) error {
+	var fs, ok = o.fs.(DiskUsageFS)
+	if !o.checkSpace || !ok {
+		return nil
+	}
+	var usage, err = fs.DiskUsage(dir)
+	if err != nil {
+		return err
+	}
+	var required = o.expectedSize + o.spaceMargin
+	if required > 0 && uint64(required) > usage.Available {
+		return errors.Wrap(ErrInsufficientSpace, "%d bytes are required in %q, but only %d are available", required,
+			filepath.Clean(dir), usage.Available)
+	}
+	return nil
+}
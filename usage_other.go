@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || dragonfly || freebsd || windows)
+// +build !linux,!darwin,!dragonfly,!freebsd,!windows
+
+package fileutils
+
+import "os"
+
+func diskUsage(path string) (Usage, error) {
+	return Usage{}, &os.PathError{Op: "statfs", Path: path, Err: errUnsupported}
+}
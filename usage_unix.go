@@ -0,0 +1,24 @@
+//go:build linux || darwin || dragonfly || freebsd
+// +build linux darwin dragonfly freebsd
+
+package fileutils
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func diskUsage(path string) (Usage, error) {
+	var stat unix.Statfs_t
+	var err = unix.Statfs(path, &stat)
+	if err != nil {
+		return Usage{}, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	var blockSize = uint64(stat.Bsize)
+	return Usage{
+		Total:     uint64(stat.Blocks) * blockSize,
+		Free:      uint64(stat.Bfree) * blockSize,
+		Available: uint64(stat.Bavail) * blockSize,
+	}, nil
+}
@@ -0,0 +1,24 @@
+package fileutils
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+func diskUsage(path string) (Usage, error) {
+	var name, err = syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return Usage{}, err
+	}
+	var usage Usage
+	var ok uintptr
+	ok, _, err = getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&usage.Available)),
+		uintptr(unsafe.Pointer(&usage.Total)), uintptr(unsafe.Pointer(&usage.Free)))
+	if ok == 0 {
+		return Usage{}, &os.PathError{Op: "GetDiskFreeSpaceEx", Path: path, Err: err}
+	}
+	return usage, nil
+}